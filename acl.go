@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"smtprelay/smtpd"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAccessDenied = smtpd.Error{Code: 554, Message: "5.7.1  Access denied"}
+
+// NetworkACL decides which client addresses may connect to a listener. Deny
+// entries win over allow entries; an empty allow list permits everybody not
+// denied.
+type NetworkACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+var (
+	aclMutex       sync.RWMutex
+	smtpACL        = &NetworkACL{}
+	tcpACL         = &NetworkACL{}
+	trustedProxies []*net.IPNet
+)
+
+// ParseNetworks parses CIDR blocks; a bare IP address is taken as a single host
+func ParseNetworks(networks []string) (nets []*net.IPNet, err error) {
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, errors.New("invalid address " + network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func NewNetworkACL(allow, deny []string) (acl *NetworkACL, err error) {
+	acl = &NetworkACL{}
+	if acl.Allow, err = ParseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if acl.Deny, err = ParseNetworks(deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *NetworkACL) Permit(ip net.IP) bool {
+	if containsIP(acl.Deny, ip) {
+		return false
+	}
+	return len(acl.Allow) == 0 || containsIP(acl.Allow, ip)
+}
+
+// LoadACLs builds the listener access lists from conf. On error the old lists
+// stay in force.
+func LoadACLs() error {
+	smtp, err := NewNetworkACL(conf.SMTPAllowNetworks, conf.SMTPDenyNetworks)
+	if err != nil {
+		return fmt.Errorf("SMTP network ACL: %s", err.Error())
+	}
+	tcp, err := NewNetworkACL(conf.TCPAllowNetworks, conf.TCPDenyNetworks)
+	if err != nil {
+		return fmt.Errorf("TCP network ACL: %s", err.Error())
+	}
+	proxies, err := ParseNetworks(conf.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %s", err.Error())
+	}
+	aclMutex.Lock()
+	smtpACL, tcpACL, trustedProxies = smtp, tcp, proxies
+	aclMutex.Unlock()
+	return nil
+}
+
+// IsTrustedProxy reports whether addr is a load balancer that sends a PROXY
+// protocol header ahead of the client's data
+func IsTrustedProxy(addr net.Addr) bool {
+	ip := AddrIP(addr)
+	if ip == nil {
+		return false
+	}
+	aclMutex.RLock()
+	defer aclMutex.RUnlock()
+	return containsIP(trustedProxies, ip)
+}
+
+func AddrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.ParseIP(addr.String())
+	}
+	return net.ParseIP(host)
+}
+
+// CheckNetworkAccess applies the listener's CIDR lists to addr
+func CheckNetworkAccess(listener string, addr net.Addr) error {
+	aclMutex.RLock()
+	acl := smtpACL
+	if listener == LISTENER_TCP {
+		acl = tcpACL
+	}
+	aclMutex.RUnlock()
+	ip := AddrIP(addr)
+	if ip == nil || !acl.Permit(ip) {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// CheckDNSBL looks the client address up in every zone of DNSBLZones
+func CheckDNSBL(addr net.Addr) error {
+	zones := conf.DNSBLZones
+	if len(zones) == 0 {
+		return nil
+	}
+	ip := AddrIP(addr)
+	if ip == nil {
+		return ErrAccessDenied
+	}
+	name := reverseIP(ip)
+	for _, zone := range zones {
+		started := time.Now()
+		addrs, err := net.LookupHost(name + "." + zone)
+		observeDNSLookup("dnsbl", err, started)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if listed := net.ParseIP(a); listed != nil && listed.To4() != nil && listed.To4()[0] == 127 {
+				return smtpd.Error{Code: 554, Message: fmt.Sprintf("5.7.1  Client host %s blocked using %s", ip.String(), zone)}
+			}
+		}
+	}
+	return nil
+}
+
+// reverseIP returns the DNSBL query label of ip, reversed octets for IPv4
+// and reversed nibbles for IPv6
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	labels := make([]string, 0, 2*net.IPv6len)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x.%x", ip16[i]&0x0f, ip16[i]>>4))
+	}
+	return strings.Join(labels, ".")
+}
+
+// CheckClientAccess runs the network ACL and DNSBL checks for a new connection
+func CheckClientAccess(listener string, addr net.Addr) error {
+	if err := CheckNetworkAccess(listener, addr); err != nil {
+		return err
+	}
+	return CheckDNSBL(addr)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.5", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expect := []string{"10.0.0.0/8", "192.168.1.5/32", "2001:db8::/32"}
+	for i, n := range nets {
+		if n.String() != expect[i] {
+			t.Errorf("expect '%s', got - '%s'", expect[i], n.String())
+		}
+	}
+	if _, err := ParseNetworks([]string{"not-an-address"}); err == nil {
+		t.Error("expect error for invalid address")
+	}
+}
+
+func TestNetworkACLPermit(t *testing.T) {
+	acl, err := NewNetworkACL([]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	for ip, expect := range map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.2.3":    false,
+		"192.168.1.1": false,
+	} {
+		if got := acl.Permit(net.ParseIP(ip)); got != expect {
+			t.Errorf("%s: expect %t, got - %t", ip, expect, got)
+		}
+	}
+	open := &NetworkACL{}
+	if !open.Permit(net.ParseIP("192.168.1.1")) {
+		t.Error("empty allow list must permit everyone")
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	if got := reverseIP(net.ParseIP("192.0.2.1")); got != "1.2.0.192" {
+		t.Errorf("expect '1.2.0.192', got - '%s'", got)
+	}
+	expect := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"
+	if got := reverseIP(net.ParseIP("2001:db8::1")); got != expect {
+		t.Errorf("expect '%s', got - '%s'", expect, got)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_ADMIN_HOST is where the admin API listens if AdminListen gives
+// only a port
+const DEFAULT_ADMIN_HOST = "127.0.0.1"
+
+// adminPaths are the routes of the admin API, answered with 404 on the
+// statistic server
+var adminPaths = []string{"/queue", "/queue/", "/campaigns", "/delivery", "/delivery/"}
+
+type QueueListEntry struct {
+	Queue string
+	QueueEntry
+}
+
+type QueueActionResult struct {
+	Action   string
+	Affected int
+}
+
+// NewAdminHandler returns the admin API. Every request needs the
+// AdminToken as bearer token; without a token configured the API answers
+// 404 to everything.
+func NewAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queue", QueueListHandler)
+	mux.HandleFunc("/queue/retry", queueActionHandler("retry", RetryMail))
+	mux.HandleFunc("/queue/delete", queueActionHandler("delete", DeleteMail))
+	mux.HandleFunc("/queue/hold", queueActionHandler("hold", func(filter QueueFilter) int {
+		return HoldMail(filter, true)
+	}))
+	mux.HandleFunc("/queue/release", queueActionHandler("release", func(filter QueueFilter) int {
+		return HoldMail(filter, false)
+	}))
+	mux.HandleFunc("/queue/schedule", QueueScheduleHandler)
+	mux.HandleFunc("/campaigns", CampaignsHandler)
+	mux.HandleFunc("/delivery", DeliveryHoldsHandler)
+	mux.HandleFunc("/delivery/hold", deliveryHoldHandler(Holds.Hold))
+	mux.HandleFunc("/delivery/release", deliveryHoldHandler(Holds.Release))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := conf.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// AdminAddress returns the address the admin API listens on for listen, a
+// host:port or just a port, which listens on DEFAULT_ADMIN_HOST
+func AdminAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		host, port = "", strings.TrimPrefix(listen, ":")
+	}
+	if host == "" {
+		host = DEFAULT_ADMIN_HOST
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// StartAdminServer serves the admin API on AdminListen, if both it and
+// AdminToken are set
+func StartAdminServer() {
+	if conf.AdminListen == "" || conf.AdminToken == "" {
+		log.Info("SYSTEM: Admin API disabled, set AdminListen and AdminToken to enable it")
+		return
+	}
+	addr := AdminAddress(conf.AdminListen)
+	log.Info("SYSTEM: Admin API started at %s", addr)
+	if err := http.ListenAndServe(addr, NewAdminHandler()); err != nil {
+		log.Critical("can't start admin API at %s:%s", addr, err.Error())
+	}
+}
+
+// parseQueueFilter reads id, domain, sender, campaign and age (seconds) from
+// the query
+func parseQueueFilter(r *http.Request) (filter QueueFilter, err error) {
+	query := r.URL.Query()
+	filter.Id = query.Get("id")
+	filter.Domain = query.Get("domain")
+	filter.Sender = query.Get("sender")
+	filter.Campaign = query.Get("campaign")
+	if age := query.Get("age"); age != "" {
+		seconds, err := strconv.Atoi(age)
+		if err != nil || seconds < 0 {
+			return filter, errors.New("age must be a positive number of seconds")
+		}
+		filter.MinAge = time.Duration(seconds) * time.Second
+	}
+	return filter, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		log.Error("can't marshal admin response:%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// QueueListHandler lists queued, deferred and scheduled entries, optionally
+// limited to one queue with ?queue=mail|deferred|scheduled
+func QueueListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseQueueFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var queues []*Queue
+	switch r.URL.Query().Get("queue") {
+	case "":
+		queues = []*Queue{MailQueue, ErrorQueue, ScheduledQueue}
+	case MAIL_QUEUE_NAME:
+		queues = []*Queue{MailQueue}
+	case ERROR_QUEUE_NAME:
+		queues = []*Queue{ErrorQueue}
+	case SCHEDULED_QUEUE_NAME:
+		queues = []*Queue{ScheduledQueue}
+	default:
+		http.Error(w, "unknown queue", http.StatusBadRequest)
+		return
+	}
+	list := []QueueListEntry{}
+	for _, q := range queues {
+		for _, entry := range q.Find(filter) {
+			list = append(list, QueueListEntry{Queue: q.Name, QueueEntry: entry})
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func queueActionHandler(action string, fn func(filter QueueFilter) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filter, err := parseQueueFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.IsEmpty() {
+			http.Error(w, "id, domain, sender, campaign or age required", http.StatusBadRequest)
+			return
+		}
+		log.Info("SYSTEM: queue %s requested from %s for %+v", action, r.RemoteAddr, filter)
+		writeJSON(w, http.StatusOK, QueueActionResult{Action: action, Affected: fn(filter)})
+	}
+}
+
+// QueueScheduleHandler sets the send-after time of the entries matching the
+// filter to ?at= (unix seconds), or sends them right away with at=0
+func QueueScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	at, err := strconv.ParseInt(r.URL.Query().Get("at"), 10, 64)
+	if err != nil || at < 0 {
+		http.Error(w, "at must be a unix time in seconds", http.StatusBadRequest)
+		return
+	}
+	var sendAfter time.Time
+	if at > 0 {
+		sendAfter = time.Unix(at, 0)
+	}
+	queueActionHandler("schedule", func(filter QueueFilter) int {
+		return ScheduleMail(filter, sendAfter)
+	})(w, r)
+}
+
+// CampaignsHandler reports the counts of all campaigns, or of one with
+// ?campaign=
+func CampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	states := Campaigns.State(r.URL.Query().Get("campaign"), QueuedByCampaign())
+	if states == nil {
+		states = []CampaignState{}
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// DeliveryHoldsHandler reports the domains whose delivery is on hold
+func DeliveryHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, Holds.State())
+}
+
+// deliveryHoldHandler applies fn to ?domain=, or to all domains with ?all=true
+func deliveryHoldHandler(fn func(domain string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		domain := query.Get("domain")
+		if domain == "" && query.Get("all") != "true" {
+			http.Error(w, "domain or all=true required", http.StatusBadRequest)
+			return
+		}
+		log.Info("SYSTEM: %s requested from %s", r.URL.Path, r.RemoteAddr)
+		fn(domain)
+		writeJSON(w, http.StatusOK, Holds.State())
+	}
+}
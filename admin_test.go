@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandlerToken(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	InitQueues()
+	handler := NewAdminHandler()
+
+	for _, c := range []struct {
+		token, auth string
+		expect      int
+	}{
+		{"", "", http.StatusNotFound},
+		{"", "Bearer ", http.StatusNotFound},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	} {
+		conf = &Conf{AdminToken: c.token}
+		r := httptest.NewRequest("GET", "/queue", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.expect {
+			t.Errorf("token %q, authorization %q: expect %d, got - %d", c.token, c.auth, c.expect, w.Code)
+		}
+	}
+}
+
+func TestAdminAddress(t *testing.T) {
+	for listen, expect := range map[string]string{
+		"8086":         "127.0.0.1:8086",
+		":8086":        "127.0.0.1:8086",
+		"0.0.0.0:8086": "0.0.0.0:8086",
+		"[::1]:8086":   "[::1]:8086",
+	} {
+		if got := AdminAddress(listen); got != expect {
+			t.Errorf("%s: expect '%s', got - '%s'", listen, expect, got)
+		}
+	}
+}
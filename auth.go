@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"os"
+	"smtprelay/smtpd"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AUTH_HTTP_TIMEOUT = 10 * time.Second
+
+// Authenticator checks SMTP AUTH credentials. It returns ErrAuthInvalid for
+// wrong credentials and ErrTempAuthFailure if the backend can't answer.
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
+var (
+	authenticator      Authenticator
+	authenticatorMutex sync.RWMutex
+)
+
+// HtpasswdAuthenticator checks credentials against an htpasswd-style file
+// with bcrypt hashes, one "user:hash" per line
+type HtpasswdAuthenticator struct {
+	users map[string][]byte
+}
+
+func LoadHtpasswd(filename string) (*HtpasswdAuthenticator, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	auth := &HtpasswdAuthenticator{users: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			log.Warn("htpasswd %s: skipping line for %s, only bcrypt hashes are supported", filename, parts[0])
+			continue
+		}
+		auth.users[parts[0]] = []byte(parts[1])
+	}
+	return auth, scanner.Err()
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username, password string) error {
+	hash, found := a.users[username]
+	if !found {
+		return ErrAuthInvalid
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return ErrAuthInvalid
+	}
+	return nil
+}
+
+// HTTPAuthenticator posts username and password as a form to URL. A 2xx
+// answer accepts the credentials, 401 or 403 rejects them.
+type HTTPAuthenticator struct {
+	URL    string
+	Client *http.Client
+}
+
+func (a *HTTPAuthenticator) Authenticate(username, password string) error {
+	resp, err := a.Client.PostForm(a.URL, url.Values{"username": {username}, "password": {password}})
+	if err != nil {
+		log.Error("auth callback %s failed: %s", a.URL, err.Error())
+		return ErrTempAuthFailure
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ErrAuthInvalid
+	}
+	log.Error("auth callback %s answered %s", a.URL, resp.Status)
+	return ErrTempAuthFailure
+}
+
+// ChainAuthenticator tries each authenticator in turn until one accepts
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(username, password string) (err error) {
+	for _, a := range c {
+		if err = a.Authenticate(username, password); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// LoadAuthenticator builds the credential backend from conf. It returns nil
+// if no backend is configured, which disables SMTP AUTH.
+func LoadAuthenticator() (Authenticator, error) {
+	var chain ChainAuthenticator
+	if conf.AuthHtpasswdFile != "" {
+		htpasswd, err := LoadHtpasswd(conf.AuthHtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("SYSTEM: %d users loaded from %s", len(htpasswd.users), conf.AuthHtpasswdFile)
+		chain = append(chain, htpasswd)
+	}
+	if conf.AuthHTTPURL != "" {
+		chain = append(chain, &HTTPAuthenticator{URL: conf.AuthHTTPURL, Client: &http.Client{Timeout: AUTH_HTTP_TIMEOUT}})
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+func SetAuthenticator(a Authenticator) {
+	authenticatorMutex.Lock()
+	authenticator = a
+	authenticatorMutex.Unlock()
+}
+
+func GetAuthenticator() Authenticator {
+	authenticatorMutex.RLock()
+	defer authenticatorMutex.RUnlock()
+	return authenticator
+}
+
+// ReloadAuthenticator rereads the credential backend, keeping the old one
+// on error. Enabling or disabling AUTH needs a restart.
+func ReloadAuthenticator() {
+	if GetAuthenticator() == nil {
+		return
+	}
+	a, err := LoadAuthenticator()
+	if err != nil {
+		log.Critical("can't reload SMTP AUTH backend, old settings will be used:%s", err.Error())
+		return
+	}
+	if a == nil {
+		log.Critical("SMTP AUTH backend removed from config, old settings will be used until restart")
+		return
+	}
+	SetAuthenticator(a)
+}
+
+func smtpAuthenticator(peer smtpd.Peer, username, password string) error {
+	a := GetAuthenticator()
+	if a == nil {
+		return ErrTempAuthFailure
+	}
+	if err := a.Authenticate(username, password); err != nil {
+		log.Warn("AUTH failed for %s from %s: %s", username, peer.Addr.String(), err.Error())
+		return err
+	}
+	log.Info("AUTH %s from %s accepted", username, peer.Addr.String())
+	return nil
+}
+
+// smtpSenderChecker refuses MAIL FROM from unauthenticated clients on
+// listeners requiring AUTH, and for sender domains the client may not use
+func smtpSenderChecker(requireAuth bool, peer smtpd.Peer, addr string) error {
+	if requireAuth && peer.Username == "" {
+		log.Warn("MAIL FROM:<%s> from %s rejected: %s", addr, peer.Addr.String(), ErrAuthRequired.Error())
+		return ErrAuthRequired
+	}
+	if domain := AddressDomain(addr); domain != "" {
+		if err := CheckSenderDomain(peer.Username, peer.Addr, domain); err != nil {
+			log.Warn("MAIL FROM:<%s> from %s rejected: %s", addr, peer.Addr.String(), err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func LoadTLSConfig() (*tls.Config, error) {
+	if conf.TLSCertFile == "" && conf.TLSKeyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// ConfigureSMTPSecurity sets up TLS and AUTH on server for a listener
+// profile. AUTH is offered on every TLS listener once a credential backend
+// is configured; RequireAuth makes it mandatory for relaying.
+func ConfigureSMTPSecurity(server *smtpd.Server, profile ListenerConf, tlsConfig *tls.Config) error {
+	switch profile.Mode {
+	case LISTENER_MODE_PLAIN:
+	case LISTENER_MODE_STARTTLS, LISTENER_MODE_TLS:
+		if tlsConfig == nil {
+			return fmt.Errorf("listener %s: mode %s requires TLSCertFile and TLSKeyFile", profile.Name, profile.Mode)
+		}
+		server.TLSConfig = tlsConfig
+		server.ForceTLS = profile.Mode == LISTENER_MODE_STARTTLS && conf.ForceTLS
+	default:
+		return fmt.Errorf("listener %s: unknown mode %q", profile.Name, profile.Mode)
+	}
+	a := GetAuthenticator()
+	if profile.RequireAuth {
+		if a == nil {
+			return fmt.Errorf("listener %s: RequireAuth needs AuthHtpasswdFile or AuthHTTPURL", profile.Name)
+		}
+		if server.TLSConfig == nil {
+			return errors.New("SMTP AUTH requires TLSCertFile and TLSKeyFile")
+		}
+	}
+	if a != nil && server.TLSConfig != nil {
+		server.Authenticator = smtpAuthenticator
+	}
+	server.SenderChecker = func(peer smtpd.Peer, addr string) error {
+		return smtpSenderChecker(profile.RequireAuth, peer, addr)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# users\nalice:" + string(hash) + "\nbob:{SHA}plain\n")
+	file.Close()
+
+	auth, err := LoadHtpasswd(file.Name())
+	if err != nil {
+		t.Fatalf("can't load htpasswd: %s", err)
+	}
+	if err := auth.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("expect alice accepted, got - '%s'", err)
+	}
+	if err := auth.Authenticate("alice", "wrong"); !reflect.DeepEqual(err, ErrAuthInvalid) {
+		t.Errorf("expect '%s', got - '%v'", ErrAuthInvalid.Error(), err)
+	}
+	if err := auth.Authenticate("bob", "plain"); !reflect.DeepEqual(err, ErrAuthInvalid) {
+		t.Errorf("expect '%s' for non-bcrypt entry, got - '%v'", ErrAuthInvalid.Error(), err)
+	}
+}
+
+func TestHTTPAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("username") {
+		case "alice":
+			if r.FormValue("password") == "secret" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	auth := ChainAuthenticator{&HTTPAuthenticator{URL: server.URL, Client: server.Client()}}
+	if err := auth.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("expect alice accepted, got - '%s'", err)
+	}
+	if err := auth.Authenticate("alice", "wrong"); !reflect.DeepEqual(err, ErrAuthInvalid) {
+		t.Errorf("expect '%s', got - '%v'", ErrAuthInvalid.Error(), err)
+	}
+	if err := auth.Authenticate("carol", "x"); !reflect.DeepEqual(err, ErrTempAuthFailure) {
+		t.Errorf("expect '%s', got - '%v'", ErrTempAuthFailure.Error(), err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"smtprelay/smtpd"
+	"sync/atomic"
+)
+
+var (
+	ErrQueueFull        = smtpd.Error{Code: 452, Message: "4.3.1  Queue is full, try again later"}
+	ErrQueueFullSession = smtpd.Error{Code: 421, Message: "4.3.2  Queue is full, try again later"}
+	ErrScheduledFull    = smtpd.Error{Code: 452, Message: "4.3.1  Scheduled queue is full, try again later"}
+)
+
+// SCHEDULED_HIGH_WATERMARK is the number of scheduled entries from which new
+// scheduled mail is refused. It is below MAX_SCHEDULED_BUFFER_SIZE, so
+// handlers passing the check at the same time still find room instead of
+// blocking in PushMail.
+const SCHEDULED_HIGH_WATERMARK = MAX_SCHEDULED_BUFFER_SIZE - 100000
+
+// intakeThrottled is 1 from the time the queue reaches QueueHighWatermark
+// until it drains to QueueLowWatermark
+var intakeThrottled int32
+
+// queueWatermarks returns the high and low watermark, the low one defaulting
+// to the high one. A zero high watermark disables throttling.
+func queueWatermarks() (high, low int64) {
+	high, low = int64(conf.QueueHighWatermark), int64(conf.QueueLowWatermark)
+	if low <= 0 || low > high {
+		low = high
+	}
+	return
+}
+
+// IntakeThrottled reports whether new messages are refused because the queue
+// is near capacity, updating the state from the number of entries waiting
+// for delivery. Scheduled entries don't count, they aren't due yet.
+func IntakeThrottled() bool {
+	high, low := queueWatermarks()
+	if high <= 0 {
+		atomic.StoreInt32(&intakeThrottled, 0)
+		return false
+	}
+	size := GetDeliveryQueueLength()
+	if atomic.LoadInt32(&intakeThrottled) == 1 {
+		if size <= low && atomic.CompareAndSwapInt32(&intakeThrottled, 1, 0) {
+			log.Info("SYSTEM: %d messages queued, low watermark %d reached, intake resumed", size, low)
+		}
+	} else if size >= high && atomic.CompareAndSwapInt32(&intakeThrottled, 0, 1) {
+		log.Warn("SYSTEM: %d messages queued, high watermark %d reached, intake throttled", size, high)
+	}
+	return atomic.LoadInt32(&intakeThrottled) == 1
+}
+
+// ScheduledQueueFull reports whether count more scheduled entries would take
+// the scheduled queue past SCHEDULED_HIGH_WATERMARK
+func ScheduledQueueFull(count int) bool {
+	return GetScheduledQueueLength()+int64(count) > SCHEDULED_HIGH_WATERMARK
+}
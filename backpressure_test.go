@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestIntakeThrottledWatermarks(t *testing.T) {
+	oldConf, oldMail, oldError, oldScheduled := conf, MailQueue, ErrorQueue, ScheduledQueue
+	defer func() {
+		conf, MailQueue, ErrorQueue, ScheduledQueue = oldConf, oldMail, oldError, oldScheduled
+		intakeThrottled = 0
+	}()
+	conf = &Conf{QueueHighWatermark: 4, QueueLowWatermark: 2}
+	MailQueue = NewQueue("test", 10)
+	ErrorQueue = NewQueue("test", 10)
+	ScheduledQueue = NewQueue("test", 10)
+
+	for i := 0; i < 3; i++ {
+		MailQueue.Push(QueueEntry{Id: strconv.Itoa(i)})
+	}
+	if IntakeThrottled() {
+		t.Errorf("expect intake below high watermark")
+	}
+	ErrorQueue.Push(QueueEntry{Id: "deferred"})
+	if !IntakeThrottled() {
+		t.Errorf("expect intake throttled at high watermark")
+	}
+
+	MailQueue.Remove(QueueFilter{Id: "0"})
+	if !IntakeThrottled() {
+		t.Errorf("expect intake throttled above low watermark")
+	}
+	MailQueue.Remove(QueueFilter{Id: "1"})
+	if IntakeThrottled() {
+		t.Errorf("expect intake resumed at low watermark")
+	}
+
+	// Scheduled mail isn't waiting for delivery yet
+	for i := 0; i < 5; i++ {
+		ScheduledQueue.Push(QueueEntry{Id: "scheduled" + strconv.Itoa(i)})
+	}
+	if IntakeThrottled() {
+		t.Errorf("expect scheduled entries not counted")
+	}
+
+	conf = &Conf{}
+	ErrorQueue.Push(QueueEntry{Id: "more"})
+	MailQueue.Push(QueueEntry{Id: "more"})
+	if IntakeThrottled() {
+		t.Errorf("expect no throttling without high watermark")
+	}
+}
+
+func TestScheduledQueueFull(t *testing.T) {
+	oldScheduled := ScheduledQueue
+	defer func() { ScheduledQueue = oldScheduled }()
+	ScheduledQueue = NewQueue("test", 10)
+	ScheduledQueue.Push(QueueEntry{Id: "1"})
+
+	if ScheduledQueueFull(SCHEDULED_HIGH_WATERMARK - 1) {
+		t.Errorf("expect room up to the scheduled high watermark")
+	}
+	if !ScheduledQueueFull(SCHEDULED_HIGH_WATERMARK) {
+		t.Errorf("expect scheduled queue full past the high watermark")
+	}
+}
@@ -3,6 +3,7 @@ CONFPATH=/usr/local/etc/smtprelay
 BINPATH=/usr/local/sbin
 BINNAME=smtprelay
 LOGPATH=/var/log
+SPOOLPATH=/var/spool/smtprelay
 LOFILE=smtprelay.log
 RCPATH=/etc/rc.d
 RCCONF=/etc/rc.conf
@@ -10,6 +11,7 @@ RCCONF=/etc/rc.conf
 echo "Creating folders and copying files"
 mkdir -p $CONFPATH
 mkdir -p $CONFPATH/dkim_keys
+mkdir -p $SPOOLPATH
 touch $LOGPATH/$LOGFILE
 cp -i conf/config.json $CONFPATH/config.json
 cp -i conf/logconfig.xml $CONFPATH/logconfig.xml
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"smtprelay/spool"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CAMPAIGN_HEADER names the campaign or batch a message belongs to. It is
+// removed from the message on intake.
+const CAMPAIGN_HEADER = "X-Campaign-Id"
+
+const MAX_CAMPAIGN_ID_LENGTH = 128
+
+// Campaigns with nothing queued are forgotten after this long without
+// activity
+const CAMPAIGN_STATS_TTL = 24 * time.Hour
+
+const (
+	CAMPAIGN_RESULT_RECEIVED = "received"
+	CAMPAIGN_RESULT_DELETED  = "deleted"
+)
+
+// CampaignCounts counts the queue entries, one per recipient domain, of a
+// campaign by outcome. Deferred is the entries deferred at the moment, not
+// yet sent, bounced or deleted; the others count since the campaign started.
+type CampaignCounts struct {
+	Received int64
+	Sent     int64
+	Deferred int64
+	Bounced  int64
+	Deleted  int64
+}
+
+type CampaignState struct {
+	Campaign string
+	Queued   int64
+	CampaignCounts
+	LastActivity time.Time
+}
+
+type campaignEntry struct {
+	counts   CampaignCounts
+	deferred map[string]bool // IDs of the deferred queue entries
+	last     time.Time
+}
+
+// CampaignStats keeps the counts of every campaign seen recently
+type CampaignStats struct {
+	sync.Mutex
+	campaigns map[string]*campaignEntry
+	now       func() time.Time
+}
+
+var Campaigns = NewCampaignStats()
+
+func NewCampaignStats() *CampaignStats {
+	return &CampaignStats{campaigns: make(map[string]*campaignEntry), now: time.Now}
+}
+
+// CampaignId cleans up a campaign ID given by a client, empty if there is
+// none
+func CampaignId(id string) string {
+	id = strings.TrimSpace(id)
+	if len(id) > MAX_CAMPAIGN_ID_LENGTH {
+		id = id[:MAX_CAMPAIGN_ID_LENGTH]
+	}
+	return id
+}
+
+// TakeCampaignId returns the campaign msg names in CAMPAIGN_HEADER, empty
+// if it doesn't, and removes the header from body
+func TakeCampaignId(msg *Msg, body *spool.Body) (string, error) {
+	value := msg.Message.Header.Get(CAMPAIGN_HEADER)
+	if value == "" {
+		return "", nil
+	}
+	return CampaignId(value), RemoveHeader(body, CAMPAIGN_HEADER)
+}
+
+// Record counts the queue entry id of campaign with result, a
+// DELIVERY_RESULT_* or CAMPAIGN_RESULT_* value. An entry counts as deferred
+// from its first deferral until its final result. Entries without a
+// campaign are ignored.
+func (c *CampaignStats) Record(campaign, id, result string) {
+	if campaign == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	entry, found := c.campaigns[campaign]
+	if !found {
+		entry = &campaignEntry{deferred: make(map[string]bool)}
+		c.campaigns[campaign] = entry
+	}
+	entry.last = c.now()
+	switch result {
+	case CAMPAIGN_RESULT_RECEIVED:
+		entry.counts.Received++
+	case DELIVERY_RESULT_SENT:
+		entry.counts.Sent++
+	case DELIVERY_RESULT_DEFERRED:
+		entry.deferred[id] = true
+	case DELIVERY_RESULT_DROPPED:
+		entry.counts.Bounced++
+	case CAMPAIGN_RESULT_DELETED:
+		entry.counts.Deleted++
+	}
+	if result != DELIVERY_RESULT_DEFERRED {
+		delete(entry.deferred, id)
+	}
+	entry.counts.Deferred = int64(len(entry.deferred))
+}
+
+// State returns the counts of campaign, or of all campaigns if it is empty,
+// with queued holding the entries each campaign has left in the queues
+func (c *CampaignStats) State(campaign string, queued map[string]int64) (states []CampaignState) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	for id, entry := range c.campaigns {
+		if queued[id] == 0 && now.Sub(entry.last) > CAMPAIGN_STATS_TTL {
+			delete(c.campaigns, id)
+			continue
+		}
+		if campaign == "" || campaign == id {
+			states = append(states, CampaignState{Campaign: id, Queued: queued[id], CampaignCounts: entry.counts, LastActivity: entry.last})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Campaign < states[j].Campaign })
+	return
+}
+
+// QueuedByCampaign counts the entries of each campaign in all queues
+func QueuedByCampaign() map[string]int64 {
+	queued := make(map[string]int64)
+	for _, q := range []*Queue{MailQueue, ErrorQueue, ScheduledQueue} {
+		for id, count := range q.CountBy(func(entry *QueueEntry) string { return entry.CampaignId }) {
+			queued[id] += count
+		}
+	}
+	return queued
+}
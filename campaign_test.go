@@ -0,0 +1,85 @@
+package main
+
+import (
+	"smtprelay/spool"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCampaignStats(t *testing.T) {
+	clock := time.Unix(1000000, 0)
+	c := NewCampaignStats()
+	c.now = func() time.Time { return clock }
+
+	for _, id := range []string{"1", "2", "3"} {
+		c.Record("spring", id, CAMPAIGN_RESULT_RECEIVED)
+	}
+	// Entry 1 is deferred twice and then sent, entry 2 deferred and still
+	// queued, entry 3 bounced
+	for _, r := range []struct{ id, result string }{
+		{"1", DELIVERY_RESULT_DEFERRED}, {"2", DELIVERY_RESULT_DEFERRED}, {"1", DELIVERY_RESULT_DEFERRED},
+		{"1", DELIVERY_RESULT_SENT}, {"3", DELIVERY_RESULT_DROPPED},
+	} {
+		c.Record("spring", r.id, r.result)
+	}
+	c.Record("autumn", "4", CAMPAIGN_RESULT_RECEIVED)
+	c.Record("", "5", CAMPAIGN_RESULT_RECEIVED)
+
+	states := c.State("", map[string]int64{"spring": 1})
+	if len(states) != 2 || states[0].Campaign != "autumn" {
+		t.Fatalf("expect autumn and spring, got - %v", states)
+	}
+	expect := CampaignState{Campaign: "spring", Queued: 1, LastActivity: clock,
+		CampaignCounts: CampaignCounts{Received: 3, Sent: 1, Deferred: 1, Bounced: 1}}
+	if states[1] != expect {
+		t.Errorf("expect '%+v', got - '%+v'", expect, states[1])
+	}
+	c.Record("spring", "2", CAMPAIGN_RESULT_DELETED)
+	if states := c.State("spring", nil); len(states) != 1 || states[0].Deferred != 0 || states[0].Deleted != 1 {
+		t.Errorf("expect no deferred entries left after delete, got - %v", states)
+	}
+
+	// Idle campaigns are forgotten once nothing of them is queued
+	clock = clock.Add(CAMPAIGN_STATS_TTL + time.Second)
+	if states := c.State("", map[string]int64{"spring": 1}); len(states) != 1 || states[0].Campaign != "spring" {
+		t.Errorf("expect only spring left, got - %v", states)
+	}
+	if states := c.State("spring", nil); len(states) != 0 {
+		t.Errorf("expect spring forgotten, got - %v", states)
+	}
+}
+
+func TestCampaignFilter(t *testing.T) {
+	q := NewQueue("test", 10)
+	q.Push(QueueEntry{Id: "1", CampaignId: "spring"})
+	q.Push(QueueEntry{Id: "2", CampaignId: "spring"})
+	q.Push(QueueEntry{Id: "3"})
+
+	if counts := q.CountBy(func(entry *QueueEntry) string { return entry.CampaignId }); len(counts) != 1 || counts["spring"] != 2 {
+		t.Errorf("expect 2 entries of spring, got - %v", counts)
+	}
+	if n := q.Update(QueueFilter{Campaign: "spring"}, func(entry *QueueEntry) { entry.Held = true }); n != 2 {
+		t.Errorf("expect 2 entries held, got - %d", n)
+	}
+	if id := CampaignId(" " + strings.Repeat("x", 200) + " "); len(id) != MAX_CAMPAIGN_ID_LENGTH {
+		t.Errorf("expect campaign ID cut to %d, got - %d", MAX_CAMPAIGN_ID_LENGTH, len(id))
+	}
+}
+
+func TestTakeCampaignId(t *testing.T) {
+	conf = &Conf{ServerHostName: "relay.example.net"}
+	body := spool.NewBody([]byte("X-Campaign-Id:  spring-sale \r\nSubject: test\r\n\r\nbody\r\n"))
+	msg, err := ParseMessageBody([]string{"<a@example.com>"}, "<sender@example.com>", body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	campaign, err := TakeCampaignId(&msg, body)
+	if err != nil || campaign != "spring-sale" {
+		t.Errorf("expect 'spring-sale', got - '%s' (%v)", campaign, err)
+	}
+	data, _ := body.Bytes()
+	if strings.Contains(string(data), CAMPAIGN_HEADER) {
+		t.Errorf("expect %s removed, got - '%s'", CAMPAIGN_HEADER, data)
+	}
+}
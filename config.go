@@ -8,6 +8,21 @@ import (
 	"reflect"
 )
 
+// ListenerConf is an SMTP listener profile. Mode is "plain", "starttls" or
+// "tls" (implicit TLS); empty WelcomeMessage, MaxRecipients and
+// MaxMessageSize fall back to the global settings. Priority ("high",
+// "normal" or "bulk") applies to messages without a priority header.
+type ListenerConf struct {
+	Name           string
+	Address        string
+	Mode           string
+	RequireAuth    bool
+	MaxMessageSize int
+	MaxRecipients  int
+	WelcomeMessage string
+	Priority       string
+}
+
 type Conf struct {
 	ServerHostName          string
 	ListenPort              string
@@ -23,10 +38,40 @@ type Conf struct {
 	DeferredMailDelay       int
 	DeferredMailMaxErrors   int
 	MaxRecipients           int
+	MaxMessageSize          int
 	ListenTCPPort           string
 	TCPMaxConnections       int
 	TCPMaxHandlers          int
 	TCPTimeoutSeconds       int
+	TCPPriority             string
+	QueueHighWatermark      int
+	QueueLowWatermark       int
+	TLSCertFile             string
+	TLSKeyFile              string
+	ForceTLS                bool
+	AuthHtpasswdFile        string
+	AuthHTTPURL             string
+	SMTPAllowNetworks       []string
+	SMTPDenyNetworks        []string
+	TCPAllowNetworks        []string
+	TCPDenyNetworks         []string
+	DNSBLZones              []string
+	TrustedProxies          []string
+	UserSenderDomains       map[string][]string
+	NetworkSenderDomains    map[string][]string
+	StrictSenderDomains     bool
+	Listeners               []ListenerConf
+	SpoolDir                string
+	SpoolThreshold          int
+	XRelayHeaders           bool
+	HeaderRules             []HeaderRuleConf
+	ClientRateLimit         RateLimitConf
+	AuthUserRateLimit       RateLimitConf
+	SenderDomainRateLimit   RateLimitConf
+	DSNFailureWithoutNotify bool
+	AdminListen             string
+	AdminToken              string
+	ShutdownHeldMail        string // SHUTDOWN_HELD_WAIT (default) or SHUTDOWN_HELD_RELEASE
 }
 
 func (cf *Conf) Load(filename string) error {
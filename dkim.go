@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
 	"smtprelay/dkim"
+	"smtprelay/spool"
 	"strings"
+	"sync"
 )
 
 const KEY_CONFIG_SUFFIX string = ".config"
@@ -83,25 +84,53 @@ func DKIMLoadConfig(filename string) (keyConfig DKIM, err error) {
 	return keyConfig, nil
 }
 
-func DKIMSign(data []byte, domain string) ([]byte, error) {
+// DKIMSignatureHeader returns the DKIM-Signature header to prepend to body.
+// The body is streamed through the hash, not loaded into memory.
+func DKIMSignatureHeader(body *spool.Body, domain string) (string, error) {
 	var err error
 	privKey := DKIMRepo[domain]
 	if len(privKey.Domain) == 0 {
-		return data, errors.New("no key in keyrepo")
+		return "", errors.New("no key in keyrepo")
 	}
 
 	privKey.dkim.Conf, err = dkim.NewConf(privKey.Domain, privKey.Selector)
 	if err != nil {
-		return data, err
+		return "", err
 	}
 
-	if bytes.Index(data, []byte("\r\n")) < 0 {
-		data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+	data, err := body.Open()
+	if err != nil {
+		return "", err
 	}
-	signeddata, err := privKey.dkim.Sign(data)
+	defer data.Close()
+	header, err := privKey.dkim.SignatureHeader(data)
 	if err != nil {
 		log.Error("DKIM signing error: %v", err)
-		return data, err
+		return "", err
+	}
+	return header, nil
+}
+
+// DKIMSignature is the DKIM-Signature header of one message. It is made
+// once and shared by the queue entries the message is split into, since
+// they all send the same body signed for the same sender domain.
+type DKIMSignature struct {
+	mutex  sync.Mutex
+	header string
+}
+
+// Header returns the signature header for body, signing it on first use.
+// Errors aren't kept, so a later delivery attempt signs again.
+func (s *DKIMSignature) Header(body *spool.Body, domain string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.header != "" {
+		return s.header, nil
+	}
+	header, err := DKIMSignatureHeader(body, domain)
+	if err != nil {
+		return "", err
 	}
-	return signeddata, nil
+	s.header = header
+	return header, nil
 }
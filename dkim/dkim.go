@@ -1,12 +1,15 @@
 package dkim
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"io"
 	"regexp"
 	"strings"
 )
@@ -96,7 +99,53 @@ func (d *DKIM) canonicalBodyHash(body []byte) []byte {
 	return digest.Sum(nil)
 }
 
+// BodyHash returns the canonical body hash of the body read from r. Lines
+// are streamed through the hash one at a time; bare LF line ends are taken
+// as CRLF, as they are sent on the wire.
+func (d *DKIM) BodyHash(r io.Reader) ([]byte, error) {
+	reader := bufio.NewReader(r)
+	digest := d.Conf.Hash().New()
+	relaxed := d.Conf.RelaxedBody()
+	emptyLines := 0
+	empty := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if relaxed {
+			line = bytes.TrimRight(rxWsCompress.ReplaceAll(line, []byte(" ")), " ")
+		}
+		// Empty lines are held back, trailing ones aren't part of the body
+		if len(line) == 0 {
+			emptyLines++
+		} else {
+			for ; emptyLines > 0; emptyLines-- {
+				digest.Write([]byte("\r\n"))
+			}
+			digest.Write(line)
+			digest.Write([]byte("\r\n"))
+			empty = false
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if empty && !relaxed {
+		digest.Write([]byte("\r\n"))
+	}
+	return digest.Sum(nil), nil
+}
+
 func (d *DKIM) signableHeaderBlock(header, body []byte) string {
+	return d.signableHeaderBlockWithHash(header, d.canonicalBodyHash(body))
+}
+
+func (d *DKIM) signableHeaderBlockWithHash(header, bodyHash []byte) string {
 	headerList := ParseHeaderList(header)
 	signableHeaderList := make(HeaderList, 0, len(headerList)+1)
 
@@ -106,7 +155,7 @@ func (d *DKIM) signableHeaderBlock(header, body []byte) string {
 		}
 	}
 
-	d.Conf[BodyHashKey] = base64.StdEncoding.EncodeToString(d.canonicalBodyHash(body))
+	d.Conf[BodyHashKey] = base64.StdEncoding.EncodeToString(bodyHash)
 	d.Conf[FieldsKey] = signableHeaderList.Fields()
 
 	signableHeaderList = append(signableHeaderList, NewHeader(SignatureHeaderKey, d.Conf.String()))
@@ -118,7 +167,11 @@ func (d *DKIM) signableHeaderBlock(header, body []byte) string {
 }
 
 func (d *DKIM) signature(header, body []byte) (string, error) {
-	block := d.signableHeaderBlock(header, body)
+	return d.signatureWithHash(header, d.canonicalBodyHash(body))
+}
+
+func (d *DKIM) signatureWithHash(header, bodyHash []byte) (string, error) {
+	block := d.signableHeaderBlockWithHash(header, bodyHash)
 	hash := d.Conf.Hash()
 	digest := hash.New()
 	digest.Write([]byte(block))
@@ -155,3 +208,24 @@ func (d *DKIM) Sign(eml []byte) (signed []byte, err error) {
 
 	return
 }
+
+// SignatureHeader returns the DKIM-Signature header field, CRLF terminated,
+// to prepend to the message read from eml. The body is hashed while it is
+// read, so a large message doesn't have to be held in memory.
+func (d *DKIM) SignatureHeader(eml io.Reader) (string, error) {
+	reader := bufio.NewReader(eml)
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return "", err
+	}
+	bodyHash, err := d.BodyHash(reader)
+	if err != nil {
+		return "", err
+	}
+	sig, err := d.signatureWithHash(header, bodyHash)
+	if err != nil {
+		return "", err
+	}
+	d.Conf[SignatureDataKey] = sig
+	return string(NewHeader(SignatureHeaderKey, d.Conf.String())) + "\r\n", nil
+}
@@ -1,7 +1,9 @@
 package dkim
 
 import (
+	"bytes"
 	"encoding/base64"
+	"strings"
 	"testing"
 )
 
@@ -229,3 +231,49 @@ func TestSignedEML(t *testing.T) {
 		t.Fatal(x, "\n----\n", expect)
 	}
 }
+
+func TestBodyHash(t *testing.T) {
+	conf, _ := NewConf("domain", "selector")
+	dkim, _ := New(conf, dkimSamplePEMData)
+	enc := base64.StdEncoding
+
+	for _, c := range []string{"relaxed/simple", "relaxed/relaxed"} {
+		conf[CanonicalizationKey] = c
+		for _, eml := range []string{dkimSampleEML1, dkimSampleEML2, dkimSampleEML3} {
+			_, body, err := splitEML([]byte(eml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash, err := dkim.BodyHash(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x, expect := enc.EncodeToString(hash), enc.EncodeToString(dkim.canonicalBodyHash(body)); x != expect {
+				t.Fatal(c, x, expect)
+			}
+			lf := bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+			if hash2, _ := dkim.BodyHash(bytes.NewReader(lf)); !bytes.Equal(hash, hash2) {
+				t.Fatal(c, "LF body hash differs from CRLF")
+			}
+		}
+
+		hash, _ := dkim.BodyHash(strings.NewReader(""))
+		if x, expect := enc.EncodeToString(hash), enc.EncodeToString(dkim.canonicalBodyHash(nil)); x != expect {
+			t.Fatal(c, "empty body", x, expect)
+		}
+	}
+}
+
+func TestSignatureHeader(t *testing.T) {
+	header, err := dkimSignable().SignatureHeader(strings.NewReader(dkimSampleEML3))
+	if err != nil {
+		t.Fatal("error not nil", err)
+	}
+	expect := "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=s3ig.com; q=dns/txt; s=dkim;" +
+		" t=1299753716; bh=vrfP/4tQvd9QIewLlBjIlqsKMPwXXKj66neZg/smWSc=;" +
+		" h=Content-Type:From:Subject:To;" +
+		" b=enIert1AWY8K9AIxTw0qQLOO3TKuRENfJvwYWDXi6xM7IWaz+Bb83xi5YnjBH0Q8opLn643qIaXGVIU2+LBA2a44PZGtTRXYMG3sbQpcEMjfJRPAhAQOazsSlVdq4SmAChAU3g8uPj4r71JdROucZSdm/mW8IoT4IympoCiLKdQ=\r\n"
+	if header != expect {
+		t.Fatal(header, "\n----\n", expect)
+	}
+}
@@ -1,8 +1,10 @@
 package dkim
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"io"
 )
 
 func splitEML(eml []byte) (header, body []byte, err error) {
@@ -12,3 +14,27 @@ func splitEML(eml []byte) (header, body []byte, err error) {
 	err = errors.New("could not read header block")
 	return
 }
+
+// ReadHeader reads the header block up to the empty line that ends it and
+// returns it in the form splitEML does: CRLF separated, without the final
+// line end. r is left at the start of the body.
+func ReadHeader(r *bufio.Reader) (header []byte, err error) {
+	var lines [][]byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF {
+				err = errors.New("could not read header block")
+			}
+			return nil, err
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if len(line) == 0 {
+			return bytes.Join(lines, []byte("\r\n")), nil
+		}
+		if err == io.EOF {
+			return nil, errors.New("could not read header block")
+		}
+		lines = append(lines, line)
+	}
+}
@@ -1,6 +1,9 @@
 package dkim
 
 import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
 	"testing"
 )
 
@@ -31,3 +34,21 @@ func TestSplitEML(t *testing.T) {
 		t.Fatal("wrong body", x)
 	}
 }
+
+func TestReadHeader(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(utilSampleEML))
+	header, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal("error not nil", err)
+	}
+	if x := string(header); x != "A: X\r\nB : Y\t\r\n\tZ  " {
+		t.Fatal("wrong header", x)
+	}
+	if body, _ := ioutil.ReadAll(r); string(body) != " C \r\nD \t E\r\n\r\n\r\n" {
+		t.Fatal("wrong body", string(body))
+	}
+
+	if _, err := ReadHeader(bufio.NewReader(bytes.NewReader([]byte("A: X\r\n")))); err == nil {
+		t.Fatal("expect error for missing header end")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"smtprelay/dkim"
+	"smtprelay/spool"
+	"strings"
+	"testing"
+)
+
+func TestDKIMSignatureShared(t *testing.T) {
+	oldRepo := DKIMRepo
+	defer func() { DKIMRepo = oldRepo }()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	dkimConf, err := dkim.NewConf("example.com", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := dkim.New(dkimConf, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DKIMRepo = map[string]DKIM{"example.com": {Domain: "example.com", Selector: "test", Data: keyPEM, dkimConf: dkimConf, dkim: *d}}
+
+	body := spool.NewBody([]byte("From: <sender@example.com>\r\nSubject: test\r\n\r\nbody\r\n"))
+	signature := &DKIMSignature{}
+	if _, err := signature.Header(body, "unknown.example"); err == nil {
+		t.Errorf("expect error without key")
+	}
+	first, err := signature.Header(body, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, "DKIM-Signature: ") {
+		t.Errorf("expect DKIM-Signature header, got - '%s'", first)
+	}
+
+	// Later entries of the message get the header without signing again
+	DKIMRepo = map[string]DKIM{}
+	second, err := signature.Header(body, "example.com")
+	if err != nil {
+		t.Fatalf("expect cached header, got - '%s'", err.Error())
+	}
+	if second != first {
+		t.Errorf("expect '%s', got - '%s'", first, second)
+	}
+}
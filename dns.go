@@ -3,14 +3,23 @@ package main
 import (
 	"errors"
 	"fmt"
+	"golang.org/x/net/idna"
 	"net"
+	"time"
 )
 
 func lookupMailServer(domain string, errorCount int) (string, error) {
 	if domain == "localhost" || domain == "127.0.0.1" {
 		return "",errors.New(fmt.Sprintf("WTF? %s is invalid domain",domain))
 	}
-	mxList, err := net.LookupMX(domain)
+	// IDN domains are looked up by their punycode form
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %s: %s", domain, err.Error())
+	}
+	started := time.Now()
+	mxList, err := net.LookupMX(asciiDomain)
+	observeDNSLookup("mx", err, started)
 	if err != nil {
 		return "", err
 	}
@@ -43,3 +52,11 @@ func getRoundElement(mxList []*net.MX, errorCount int) (mx net.MX, err error) {
 	mx = *mxList[errorCount]
 	return
 }
+
+func observeDNSLookup(recordType string, err error, started time.Time) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	DNSLookupDuration.With(recordType, result).Observe(time.Since(started).Seconds())
+}
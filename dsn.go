@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"smtprelay/smtp"
+	"smtprelay/smtpd"
+	"smtprelay/spool"
+	"smtprelay/uuid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivery status notifications (RFC 3464) sent by the relay itself
+
+const (
+	DSN_ACTION_FAILED  = "failed"
+	DSN_ACTION_DELAYED = "delayed"
+	DSN_ACTION_RELAYED = "relayed"
+)
+
+var dsnEvents = map[string]string{
+	DSN_ACTION_FAILED:  "FAILURE",
+	DSN_ACTION_DELAYED: "DELAY",
+	DSN_ACTION_RELAYED: "SUCCESS",
+}
+
+var enhancedStatus = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}`)
+
+// DSNOptions returns the DSN parameters of entry for the next hop
+func DSNOptions(entry QueueEntry) (ret, envID string, recipients map[string]smtp.RcptOptions) {
+	recipients = make(map[string]smtp.RcptOptions)
+	for rcpt, dsn := range entry.DSN {
+		recipients[rcpt] = smtp.RcptOptions{Notify: dsn.Notify, ORcpt: dsn.ORcpt}
+	}
+	return entry.Ret, entry.EnvID, recipients
+}
+
+// EnvelopeDSN picks the DSN parameters of recipients out of all parameters
+// given with the envelope
+func EnvelopeDSN(all map[string]smtpd.RecipientDSN, recipients []string) map[string]smtpd.RecipientDSN {
+	var dsn map[string]smtpd.RecipientDSN
+	for _, rcpt := range recipients {
+		if params, found := all[rcpt]; found {
+			if dsn == nil {
+				dsn = make(map[string]smtpd.RecipientDSN)
+			}
+			dsn[rcpt] = params
+		}
+	}
+	return dsn
+}
+
+// dsnRecipients returns the recipients of entry asking to be notified about
+// action. Recipients without NOTIFY, e.g. all of those given to the TCP
+// listener, get no notices unless DSNFailureWithoutNotify reports their
+// failures.
+func dsnRecipients(entry QueueEntry, action string) (recipients []string) {
+	event := dsnEvents[action]
+	for _, rcpt := range entry.Recipients {
+		var notify []string
+		if dsn, found := entry.DSN[rcpt]; found && dsn.Notify != nil {
+			notify = dsn.Notify
+		} else if conf.DSNFailureWithoutNotify {
+			notify = []string{"FAILURE"}
+		}
+		for _, n := range notify {
+			if n == event {
+				recipients = append(recipients, rcpt)
+				break
+			}
+		}
+	}
+	return
+}
+
+// dsnStatus returns the enhanced status code (RFC 3463) of an SMTP reply
+func dsnStatus(status smtpd.Error) string {
+	if code := enhancedStatus.FindString(status.Message); code != "" {
+		return code
+	}
+	return strconv.Itoa(status.Code/100) + ".0.0"
+}
+
+// xtextDecode decodes the xtext (RFC 3461) used in ENVID and ORCPT
+func xtextDecode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readHeader returns the header block of a message, up to the empty line
+func readHeader(r io.Reader) ([]byte, error) {
+	var header bytes.Buffer
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 && len(line) > 0 {
+			return header.Bytes(), nil
+		}
+		header.Write(line)
+		if err == io.EOF {
+			return header.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeDSN writes the notification for recipients of entry to w
+func writeDSN(w io.Writer, messageId string, entry QueueEntry, action string, status smtpd.Error, recipients []string) error {
+	boundary := uuid.NewV4().String()
+	now := time.Now()
+
+	var subject, text string
+	switch action {
+	case DSN_ACTION_FAILED:
+		subject = "Delivery Status Notification (Failure)"
+		text = "Your message could not be delivered to the following recipients:"
+	case DSN_ACTION_DELAYED:
+		subject = "Delivery Status Notification (Delay)"
+		text = "Delivery of your message to the following recipients has been delayed. It will be retried:"
+	default:
+		subject = "Delivery Status Notification (Relayed)"
+		text = "Your message was relayed to a server that doesn't send delivery notifications, for the following recipients:"
+	}
+
+	fmt.Fprintf(w, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", conf.ServerHostName)
+	fmt.Fprintf(w, "To: <%s>\r\n", entry.Sender)
+	fmt.Fprintf(w, "Subject: %s\r\n", subject)
+	fmt.Fprintf(w, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Message-ID: %s\r\n", messageId)
+	fmt.Fprintf(w, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(w, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(w, "%s\r\n\r\n", text)
+	for _, rcpt := range recipients {
+		fmt.Fprintf(w, "  %s\r\n", rcpt)
+	}
+	fmt.Fprintf(w, "\r\n%d %s\r\n\r\n", status.Code, status.Message)
+
+	fmt.Fprintf(w, "--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", conf.ServerHostName)
+	if entry.EnvID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", xtextDecode(entry.EnvID))
+	}
+	fmt.Fprintf(w, "Arrival-Date: %s\r\n", entry.ReceivedTime.Format(time.RFC1123Z))
+	for _, rcpt := range recipients {
+		fmt.Fprintf(w, "\r\n")
+		if orcpt := entry.DSN[rcpt].ORcpt; orcpt != "" {
+			fmt.Fprintf(w, "Original-Recipient: %s\r\n", xtextDecode(orcpt))
+		}
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %s\r\n", rcpt)
+		fmt.Fprintf(w, "Action: %s\r\n", action)
+		if action == DSN_ACTION_RELAYED {
+			fmt.Fprintf(w, "Status: 2.0.0\r\n")
+		} else {
+			fmt.Fprintf(w, "Status: %s\r\n", dsnStatus(status))
+			if host, _, err := net.SplitHostPort(entry.MailServer); err == nil {
+				fmt.Fprintf(w, "Remote-MTA: dns; %s\r\n", host)
+			}
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %d %s\r\n", status.Code, status.Message)
+		}
+	}
+	fmt.Fprintf(w, "\r\n")
+
+	body, err := entry.Body.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if entry.Ret == "FULL" {
+		fmt.Fprintf(w, "--%s\r\nContent-Type: message/rfc822\r\n\r\n", boundary)
+		if _, err := io.Copy(w, body); err != nil {
+			return err
+		}
+	} else {
+		header, err := readHeader(body)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+		cw := smtp.NewCRLFWriter(w)
+		if _, err := cw.Write(header); err != nil {
+			return err
+		}
+		if err := cw.End(); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "\r\n--%s--\r\n", boundary)
+	return err
+}
+
+// SendDSN queues a notification to the sender of entry about action for
+// the recipients that asked for one. Bounces, sent with the null sender,
+// are never notified about.
+func SendDSN(entry QueueEntry, action string, status smtpd.Error) error {
+	if entry.Sender == "" {
+		return nil
+	}
+	recipients := dsnRecipients(entry, action)
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	messageId := NewMessageId()
+	data := spool.NewWriter(conf.SpoolDir, int64(conf.SpoolThreshold))
+	if err := writeDSN(data, messageId, entry, action, status, recipients); err != nil {
+		data.Discard()
+		return err
+	}
+	body, err := data.Body()
+	if err != nil {
+		return err
+	}
+
+	domain, err := ParseDomain(entry.Sender)
+	if err != nil {
+		body.Release()
+		return err
+	}
+	mailServer := conf.RelayServer
+	if !conf.RelayModeEnabled {
+		mailServer, err = lookupMailServer(strings.ToLower(domain), 0)
+		if err != nil {
+			body.Release()
+			return errors.New("can't get MX record for " + domain + ": " + err.Error())
+		}
+	}
+
+	// The queue entry takes over the reference of the new body. This runs
+	// in the sender loop, so it must not block on the queue it is draining.
+	queueId := NewQueueId()
+	dsn := QueueEntry{MailServer: mailServer,
+		Id:              SubQueueId(queueId, 1),
+		QueueId:         queueId,
+		Recipients:      []string{entry.Sender},
+		Body:            body,
+		SMTPUTF8:        !smtpd.IsASCII(entry.Sender),
+		RecipientDomain: domain,
+		MessageId:       messageId}
+	if !TryPushMail(dsn) {
+		log.Warn("msg %s DSN %s waits for room in the queue", entry.String(), action)
+		go PushMail(dsn)
+	}
+	log.Info("msg %s DSN %s queued as %s to %s for %s", entry.String(), action, queueId, entry.Sender, strings.Join(recipients, ";"))
+	return nil
+}
+
+// notifySender is SendDSN for the sender loop, which only logs failures
+func notifySender(entry QueueEntry, action string, status smtpd.Error) {
+	if err := SendDSN(entry, action, status); err != nil {
+		log.Error("msg %s can't queue DSN %s: %s", entry.String(), action, err.Error())
+	}
+}
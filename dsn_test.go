@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"smtprelay/smtpd"
+	"smtprelay/spool"
+	"strings"
+	"testing"
+)
+
+func TestDSNRecipients(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	conf = &Conf{}
+	entry := QueueEntry{
+		Recipients: []string{"default@example.com", "never@example.com", "all@example.com"},
+		DSN: map[string]smtpd.RecipientDSN{
+			"never@example.com": {Notify: []string{"NEVER"}},
+			"all@example.com":   {Notify: []string{"SUCCESS", "FAILURE", "DELAY"}},
+		},
+	}
+	for action, expect := range map[string][]string{
+		DSN_ACTION_FAILED:  {"all@example.com"},
+		DSN_ACTION_DELAYED: {"all@example.com"},
+		DSN_ACTION_RELAYED: {"all@example.com"},
+	} {
+		if got := dsnRecipients(entry, action); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expect %v, got - %v", action, expect, got)
+		}
+	}
+
+	// Failures of recipients without NOTIFY only if configured
+	conf = &Conf{DSNFailureWithoutNotify: true}
+	for action, expect := range map[string][]string{
+		DSN_ACTION_FAILED:  {"default@example.com", "all@example.com"},
+		DSN_ACTION_DELAYED: {"all@example.com"},
+	} {
+		if got := dsnRecipients(entry, action); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s with DSNFailureWithoutNotify: expect %v, got - %v", action, expect, got)
+		}
+	}
+}
+
+func TestDSNStatus(t *testing.T) {
+	for status, expect := range map[smtpd.Error]string{
+		{Code: 550, Message: "5.1.1 User unknown"}: "5.1.1",
+		{Code: 554, Message: "Domain not found"}:   "5.0.0",
+		{Code: 451, Message: "4.7.1  Greylisted"}:  "4.7.1",
+	} {
+		if got := dsnStatus(status); got != expect {
+			t.Errorf("expect '%s', got - '%s'", expect, got)
+		}
+	}
+}
+
+func TestXtextDecode(t *testing.T) {
+	if got := xtextDecode("rfc822;user+2Btag@example.com"); got != "rfc822;user+tag@example.com" {
+		t.Errorf("expect 'rfc822;user+tag@example.com', got - '%s'", got)
+	}
+}
+
+func TestWriteDSN(t *testing.T) {
+	conf = &Conf{ServerHostName: "relay.example.net"}
+	data := "From: sender@example.com\r\nSubject: test\r\n\r\nsecret body\r\n"
+	entry := QueueEntry{
+		Sender:     "sender@example.com",
+		Recipients: []string{"rcpt@example.org"},
+		MailServer: "mx.example.org:25",
+		EnvID:      "QQ314159",
+		DSN:        map[string]smtpd.RecipientDSN{"rcpt@example.org": {ORcpt: "rfc822;rcpt+2Balias@example.org"}},
+		Body:       spool.NewBody([]byte(data)),
+	}
+	status := smtpd.Error{Code: 550, Message: "5.1.1 User unknown"}
+
+	var b bytes.Buffer
+	if err := writeDSN(&b, "<id@relay.example.net>", entry, DSN_ACTION_FAILED, status, entry.Recipients); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	dsn := b.String()
+	for _, expect := range []string{
+		"To: <sender@example.com>\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Reporting-MTA: dns; relay.example.net\r\n",
+		"Original-Envelope-Id: QQ314159\r\n",
+		"Original-Recipient: rfc822;rcpt+alias@example.org\r\n",
+		"Final-Recipient: rfc822; rcpt@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx.example.org\r\n",
+		"Content-Type: text/rfc822-headers\r\n\r\nFrom: sender@example.com\r\nSubject: test\r\n",
+	} {
+		if !strings.Contains(dsn, expect) {
+			t.Errorf("expect '%s' in notification, got - '%s'", expect, dsn)
+		}
+	}
+	if strings.Contains(dsn, "secret body") {
+		t.Errorf("expect only headers returned without RET=FULL")
+	}
+
+	entry.Ret = "FULL"
+	b.Reset()
+	writeDSN(&b, "<id@relay.example.net>", entry, DSN_ACTION_FAILED, status, entry.Recipients)
+	if !strings.Contains(b.String(), "Content-Type: message/rfc822\r\n\r\n"+data) {
+		t.Errorf("expect full message returned with RET=FULL, got - '%s'", b.String())
+	}
+
+	entry.Ret = ""
+	entry.Body = spool.NewBody([]byte("From: sender@example.com\nSubject: test\n\nbody\n"))
+	b.Reset()
+	writeDSN(&b, "<id@relay.example.net>", entry, DSN_ACTION_FAILED, status, entry.Recipients)
+	if expect := "\r\n\r\nFrom: sender@example.com\r\nSubject: test\r\n\r\n--"; !strings.Contains(b.String(), expect) {
+		t.Errorf("expect LF headers returned with CRLF, got - '%s'", b.String())
+	}
+}
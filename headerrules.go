@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"regexp"
+	"smtprelay/spool"
+	"strings"
+	"sync"
+)
+
+const (
+	HEADER_RULE_ADD     = "add"
+	HEADER_RULE_REMOVE  = "remove"
+	HEADER_RULE_REPLACE = "replace"
+	HEADER_RULE_REWRITE = "rewrite"
+)
+
+// HeaderRuleConf is a header rule from the config. Add puts Header: Value in
+// the message unless it has one already, Replace sets it even if it has,
+// Remove drops every Header and Rewrite replaces Pattern in every Header
+// value with Value ($1 for submatches). Value may use the placeholders
+// ${sender}, ${sender_domain}, ${message_id}, ${queue_id}, ${auth_user} and
+// ${listener}. SenderDomains and Listeners limit the rule to messages from
+// those sender domains and listeners.
+type HeaderRuleConf struct {
+	Action        string
+	Header        string
+	Value         string
+	Pattern       string
+	SenderDomains []string
+	Listeners     []string
+}
+
+type HeaderRule struct {
+	HeaderRuleConf
+	key           string // Canonical form of Header
+	pattern       *regexp.Regexp
+	senderDomains map[string]bool
+	listeners     map[string]bool
+}
+
+// HeaderContext describes the message rules are applied to
+type HeaderContext struct {
+	Sender       string
+	SenderDomain string
+	MessageId    string
+	QueueId      string
+	AuthUser     string
+	Listener     string
+}
+
+var (
+	headerRulesMutex sync.RWMutex
+	headerRules      []*HeaderRule
+)
+
+func NewHeaderRule(c HeaderRuleConf) (*HeaderRule, error) {
+	rule := &HeaderRule{HeaderRuleConf: c}
+	rule.Action = strings.ToLower(c.Action)
+	rule.Header = strings.TrimSpace(c.Header)
+	rule.key = textproto.CanonicalMIMEHeaderKey(rule.Header)
+	if rule.Header == "" {
+		return nil, errors.New("header rule without header")
+	}
+	switch rule.Action {
+	case HEADER_RULE_ADD, HEADER_RULE_REMOVE, HEADER_RULE_REPLACE:
+	case HEADER_RULE_REWRITE:
+		pattern, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("header rule for %s: %s", rule.Header, err.Error())
+		}
+		rule.pattern = pattern
+	default:
+		return nil, fmt.Errorf("header rule for %s: unknown action %s", rule.Header, c.Action)
+	}
+	if len(c.SenderDomains) > 0 {
+		rule.senderDomains = domainSet(c.SenderDomains)
+	}
+	if len(c.Listeners) > 0 {
+		rule.listeners = make(map[string]bool)
+		for _, listener := range c.Listeners {
+			rule.listeners[listener] = true
+		}
+	}
+	return rule, nil
+}
+
+// Matches reports whether the rule applies to the message described by ctx
+func (r *HeaderRule) Matches(ctx HeaderContext) bool {
+	if r.senderDomains != nil && !r.senderDomains[strings.ToLower(ctx.SenderDomain)] {
+		return false
+	}
+	if r.listeners != nil && !r.listeners[ctx.Listener] {
+		return false
+	}
+	return true
+}
+
+func (r *HeaderRule) value(ctx HeaderContext) string {
+	return strings.NewReplacer(
+		"${sender}", ctx.Sender,
+		"${sender_domain}", ctx.SenderDomain,
+		"${message_id}", ctx.MessageId,
+		"${queue_id}", ctx.QueueId,
+		"${auth_user}", ctx.AuthUser,
+		"${listener}", ctx.Listener,
+	).Replace(r.Value)
+}
+
+// LoadHeaderRules compiles the header rules from conf. On error the old
+// rules stay in force.
+func LoadHeaderRules() error {
+	var rules []*HeaderRule
+	for _, c := range conf.HeaderRules {
+		rule, err := NewHeaderRule(c)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	headerRulesMutex.Lock()
+	headerRules = rules
+	headerRulesMutex.Unlock()
+	return nil
+}
+
+func GetHeaderRules() []*HeaderRule {
+	headerRulesMutex.RLock()
+	defer headerRulesMutex.RUnlock()
+	return headerRules
+}
+
+// headerField is one header field as it appears in the message, folded
+// lines included
+type headerField struct {
+	key string
+	raw []byte
+}
+
+// readHeaderFields reads the header block of a message. It returns the
+// fields, the line end used by the message and the length of the block
+// without the empty line that ends it.
+func readHeaderFields(r io.Reader) (fields []headerField, eol string, length int64, err error) {
+	eol = "\r\n"
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, eol, 0, err
+		}
+		if length == 0 && !bytes.HasSuffix(line, []byte("\r\n")) {
+			eol = "\n"
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, eol, length, nil
+		}
+		length += int64(len(line))
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+		} else if colon := bytes.IndexByte(line, ':'); colon > 0 {
+			key := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[:colon])))
+			fields = append(fields, headerField{key: key, raw: line})
+		} else {
+			return nil, eol, 0, errors.New("malformed header line")
+		}
+		if err == io.EOF {
+			return fields, eol, length, nil
+		}
+	}
+}
+
+func newHeaderField(name, value, eol string) headerField {
+	return headerField{key: textproto.CanonicalMIMEHeaderKey(name), raw: []byte(name + ": " + value + eol)}
+}
+
+// fieldValue returns the unfolded value of f
+func fieldValue(f headerField) string {
+	raw := string(f.raw)
+	value := raw[strings.IndexByte(raw, ':')+1:]
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return strings.TrimSpace(value)
+}
+
+// apply runs the rule on fields and reports whether it changed anything
+func (r *HeaderRule) apply(fields []headerField, ctx HeaderContext, eol string) ([]headerField, bool) {
+	var result []headerField
+	found, changed := false, false
+	for _, f := range fields {
+		if f.key != r.key {
+			result = append(result, f)
+			continue
+		}
+		found = true
+		switch r.Action {
+		case HEADER_RULE_REMOVE, HEADER_RULE_REPLACE:
+			changed = true
+			continue
+		case HEADER_RULE_REWRITE:
+			value := fieldValue(f)
+			rewritten := r.pattern.ReplaceAllString(value, r.value(ctx))
+			if rewritten != value {
+				f = newHeaderField(r.Header, rewritten, eol)
+				changed = true
+			}
+		}
+		result = append(result, f)
+	}
+	if r.Action == HEADER_RULE_REPLACE || (r.Action == HEADER_RULE_ADD && !found) {
+		result = append(result, newHeaderField(r.Header, r.value(ctx), eol))
+		changed = true
+	}
+	return result, changed
+}
+
+// ApplyHeaderRules runs the header rules matching ctx on the header of body
+func ApplyHeaderRules(body *spool.Body, ctx HeaderContext) error {
+	var rules []*HeaderRule
+	for _, rule := range GetHeaderRules() {
+		if rule.Matches(ctx) {
+			rules = append(rules, rule)
+		}
+	}
+	return applyHeaderRules(body, rules, ctx)
+}
+
+// RemoveHeader drops every field called name from the header of body
+func RemoveHeader(body *spool.Body, name string) error {
+	rule, err := NewHeaderRule(HeaderRuleConf{Action: HEADER_RULE_REMOVE, Header: name})
+	if err != nil {
+		return err
+	}
+	return applyHeaderRules(body, []*HeaderRule{rule}, HeaderContext{})
+}
+
+func applyHeaderRules(body *spool.Body, rules []*HeaderRule, ctx HeaderContext) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	data, err := body.Open()
+	if err != nil {
+		return err
+	}
+	fields, eol, length, err := readHeaderFields(data)
+	data.Close()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, rule := range rules {
+		var c bool
+		fields, c = rule.apply(fields, ctx, eol)
+		changed = changed || c
+	}
+	if !changed {
+		return nil
+	}
+
+	var header bytes.Buffer
+	for _, f := range fields {
+		header.Write(f.raw)
+	}
+	body.Replace(length, header.Bytes())
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"smtprelay/spool"
+	"strings"
+	"testing"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	conf = &Conf{HeaderRules: []HeaderRuleConf{
+		{Action: "remove", Header: "X-Originating-IP"},
+		{Action: "rewrite", Header: "Received", Pattern: `[a-z0-9-]+\.corp\.internal`, Value: "internal"},
+		{Action: "replace", Header: "X-Mailer", Value: "relay"},
+		{Action: "add", Header: "List-Unsubscribe", Value: "<mailto:unsubscribe@${sender_domain}?subject=${message_id}>"},
+		{Action: "add", Header: "Feedback-ID", Value: "${queue_id}:bulk", SenderDomains: []string{"Bulk.example"}},
+		{Action: "add", Header: "X-Submission", Value: "yes", Listeners: []string{"submission"}},
+	}}
+	if err := LoadHeaderRules(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	data := "Received: from host1.corp.internal\n\tby mx.corp.internal; Mon, 1 Jan 2018 00:00:00 +0000\n" +
+		"X-Originating-IP: 10.0.0.1\nX-Mailer: internal tool\nSubject: test\n\nX-Mailer: in body\n"
+	body := spool.NewBody([]byte(data))
+	err := ApplyHeaderRules(body, HeaderContext{SenderDomain: "bulk.example", MessageId: "m1", QueueId: "q1", Listener: "smtp"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	got, _ := body.Bytes()
+	expect := "Received: from internal\tby internal; Mon, 1 Jan 2018 00:00:00 +0000\n" +
+		"Subject: test\nX-Mailer: relay\nList-Unsubscribe: <mailto:unsubscribe@bulk.example?subject=m1>\n" +
+		"Feedback-ID: q1:bulk\n\nX-Mailer: in body\n"
+	if string(got) != expect {
+		t.Errorf("expect '%s', got - '%s'", expect, got)
+	}
+}
+
+func TestHeaderRuleAddKeepsExisting(t *testing.T) {
+	conf = &Conf{HeaderRules: []HeaderRuleConf{{Action: "add", Header: "List-Unsubscribe", Value: "<mailto:u@example.com>"}}}
+	if err := LoadHeaderRules(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data := "List-Unsubscribe: <https://example.com/u>\r\n\r\nbody\r\n"
+	body := spool.NewBody([]byte(data))
+	if err := ApplyHeaderRules(body, HeaderContext{}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if got, _ := body.Bytes(); string(got) != data {
+		t.Errorf("expect '%s', got - '%s'", data, got)
+	}
+}
+
+func TestNewHeaderRuleErrors(t *testing.T) {
+	for _, c := range []HeaderRuleConf{
+		{Action: "add"},
+		{Action: "append", Header: "X-Test"},
+		{Action: "rewrite", Header: "X-Test", Pattern: "("},
+	} {
+		if _, err := NewHeaderRule(c); err == nil || !strings.Contains(err.Error(), "header rule") {
+			t.Errorf("expect error for %v, got - %v", c, err)
+		}
+	}
+}
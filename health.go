@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Listener and shutdown state reported by /readyz
+var (
+	tcpListenerUp int32
+	shuttingDown  int32
+
+	smtpListenersMutex sync.Mutex
+	smtpListenersUp    = make(map[string]bool)
+
+	// Number of DKIM keys loaded, -1 until the repository is loaded
+	dkimKeysLoaded int32 = -1
+)
+
+type ReadinessCheck struct {
+	Name    string
+	Ready   bool
+	Message string `json:",omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool
+	Checks []ReadinessCheck
+}
+
+func setFlag(flag *int32, value bool) {
+	if value {
+		atomic.StoreInt32(flag, 1)
+	} else {
+		atomic.StoreInt32(flag, 0)
+	}
+}
+
+func SetTCPListenerUp(up bool) { setFlag(&tcpListenerUp, up) }
+func SetShuttingDown()         { setFlag(&shuttingDown, true) }
+
+// SetSMTPListenerUp records the state of the named SMTP listener profile
+func SetSMTPListenerUp(name string, up bool) {
+	smtpListenersMutex.Lock()
+	smtpListenersUp[name] = up
+	smtpListenersMutex.Unlock()
+}
+
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func SetDKIMKeysLoaded(count int) { atomic.StoreInt32(&dkimKeysLoaded, int32(count)) }
+
+func flagCheck(name string, flag *int32, message string) ReadinessCheck {
+	if atomic.LoadInt32(flag) == 1 {
+		return ReadinessCheck{Name: name, Ready: true}
+	}
+	return ReadinessCheck{Name: name, Message: message}
+}
+
+// smtpListenersCheck is ready when every SMTP listener profile is bound
+func smtpListenersCheck() ReadinessCheck {
+	smtpListenersMutex.Lock()
+	defer smtpListenersMutex.Unlock()
+	if len(smtpListenersUp) == 0 {
+		return ReadinessCheck{Name: "smtp_listener", Message: "SMTP listener is not bound"}
+	}
+	var down []string
+	for name, up := range smtpListenersUp {
+		if !up {
+			down = append(down, name)
+		}
+	}
+	if len(down) > 0 {
+		sort.Strings(down)
+		return ReadinessCheck{Name: "smtp_listener", Message: "SMTP listeners not bound: " + strings.Join(down, ", ")}
+	}
+	return ReadinessCheck{Name: "smtp_listener", Ready: true}
+}
+
+func GetReadiness() (readiness Readiness) {
+	readiness.Checks = append(readiness.Checks,
+		smtpListenersCheck(),
+		flagCheck("tcp_listener", &tcpListenerUp, "TCP listener is not bound"))
+
+	shutdown := ReadinessCheck{Name: "shutdown", Ready: !IsShuttingDown()}
+	if !shutdown.Ready {
+		shutdown.Message = "shutdown in progress"
+	}
+	readiness.Checks = append(readiness.Checks, shutdown)
+
+	queue := ReadinessCheck{Name: "queue", Ready: true}
+	if IntakeThrottled() {
+		high, low := queueWatermarks()
+		queue.Ready = false
+		queue.Message = fmt.Sprintf("%d messages queued, intake throttled from %d until %d", GetDeliveryQueueLength(), high, low)
+	}
+	readiness.Checks = append(readiness.Checks, queue)
+
+	if conf.DKIMEnabled {
+		dkim := ReadinessCheck{Name: "dkim", Message: "DKIM keys not loaded yet"}
+		if keys := atomic.LoadInt32(&dkimKeysLoaded); keys == 0 {
+			dkim.Message = "no DKIM keys loaded from " + conf.DKIMKeyDir
+		} else if keys > 0 {
+			dkim.Ready = true
+			dkim.Message = fmt.Sprintf("%d DKIM keys loaded", keys)
+		}
+		readiness.Checks = append(readiness.Checks, dkim)
+	}
+
+	readiness.Ready = true
+	for _, check := range readiness.Checks {
+		readiness.Ready = readiness.Ready && check.Ready
+	}
+	return
+}
+
+// HealthHandler is the liveness probe: it answers as long as the process
+// serves HTTP
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+// ReadyHandler is the readiness probe, 503 if any check fails
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := GetReadiness()
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
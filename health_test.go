@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func readinessCheck(readiness Readiness, name string) (check ReadinessCheck, found bool) {
+	for _, check := range readiness.Checks {
+		if check.Name == name {
+			return check, true
+		}
+	}
+	return check, false
+}
+
+func TestGetReadiness(t *testing.T) {
+	oldConf, oldMail, oldError, oldScheduled := conf, MailQueue, ErrorQueue, ScheduledQueue
+	defer func() {
+		conf, MailQueue, ErrorQueue, ScheduledQueue = oldConf, oldMail, oldError, oldScheduled
+		SetTCPListenerUp(false)
+		smtpListenersMutex.Lock()
+		delete(smtpListenersUp, "test")
+		smtpListenersMutex.Unlock()
+		setFlag(&shuttingDown, false)
+		SetDKIMKeysLoaded(-1)
+		intakeThrottled = 0
+	}()
+	conf = &Conf{DKIMEnabled: true, QueueHighWatermark: 2}
+	InitQueues()
+	SetTCPListenerUp(true)
+	SetSMTPListenerUp("test", true)
+
+	expectCheck := func(name string, ready bool) {
+		t.Helper()
+		readiness := GetReadiness()
+		check, found := readinessCheck(readiness, name)
+		if !found || check.Ready != ready {
+			t.Errorf("expect %s ready %t, got - %+v", name, ready, readiness)
+		}
+		if readiness.Ready != ready {
+			t.Errorf("expect ready %t, got - %+v", ready, readiness)
+		}
+	}
+
+	SetDKIMKeysLoaded(-1)
+	expectCheck("dkim", false)
+	SetDKIMKeysLoaded(0)
+	expectCheck("dkim", false)
+	SetDKIMKeysLoaded(2)
+	expectCheck("dkim", true)
+
+	MailQueue.Push(QueueEntry{Id: "1"})
+	ErrorQueue.Push(QueueEntry{Id: "2"})
+	expectCheck("queue", false)
+	MailQueue.Remove(QueueFilter{Id: "1"})
+	ErrorQueue.Remove(QueueFilter{Id: "2"})
+	expectCheck("queue", true)
+
+	SetShuttingDown()
+	expectCheck("shutdown", false)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeliveryHolds keeps domains (or everything) whose outgoing delivery is
+// paused. It lives outside Conf, so holds survive config reloads.
+type DeliveryHolds struct {
+	sync.RWMutex
+	all     bool
+	domains map[string]bool
+}
+
+type DeliveryHoldsState struct {
+	All     bool
+	Domains []string
+}
+
+var Holds = NewDeliveryHolds()
+
+// ShutdownHeldMail values: on shutdown, wait until held mail is released or
+// deleted through the admin API, or release it into the drain
+const (
+	SHUTDOWN_HELD_WAIT    = "wait"
+	SHUTDOWN_HELD_RELEASE = "release"
+)
+
+const SHUTDOWN_HELD_WAIT_INTERVAL = 10 * time.Second
+
+func NewDeliveryHolds() *DeliveryHolds {
+	return &DeliveryHolds{domains: make(map[string]bool)}
+}
+
+func (h *DeliveryHolds) IsHeld(domain string) bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.all || h.domains[strings.ToLower(domain)]
+}
+
+func (h *DeliveryHolds) AllHeld() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.all
+}
+
+// Hold pauses delivery to domain, or to all domains if domain is empty
+func (h *DeliveryHolds) Hold(domain string) {
+	h.Lock()
+	if domain == "" {
+		h.all = true
+	} else {
+		h.domains[strings.ToLower(domain)] = true
+	}
+	h.Unlock()
+	log.Info("SYSTEM: delivery HELD for %s", holdName(domain))
+}
+
+// Release resumes delivery to domain, or lifts the global hold if domain is
+// empty. Domain holds are kept when the global hold is lifted.
+func (h *DeliveryHolds) Release(domain string) {
+	h.Lock()
+	if domain == "" {
+		h.all = false
+	} else {
+		delete(h.domains, strings.ToLower(domain))
+	}
+	h.Unlock()
+	log.Info("SYSTEM: delivery RELEASED for %s", holdName(domain))
+	MailQueue.Unpark()
+}
+
+// ReleaseAll lifts the global hold and all domain holds
+func (h *DeliveryHolds) ReleaseAll() {
+	h.Lock()
+	h.all = false
+	h.domains = make(map[string]bool)
+	h.Unlock()
+	log.Info("SYSTEM: delivery RELEASED for all domains and holds")
+	MailQueue.Unpark()
+}
+
+func (h *DeliveryHolds) State() (state DeliveryHoldsState) {
+	h.RLock()
+	defer h.RUnlock()
+	state.All = h.all
+	state.Domains = make([]string, 0, len(h.domains))
+	for domain := range h.domains {
+		state.Domains = append(state.Domains, domain)
+	}
+	sort.Strings(state.Domains)
+	return
+}
+
+func holdName(domain string) string {
+	if domain == "" {
+		return "all domains"
+	}
+	return domain
+}
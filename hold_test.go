@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryHoldPop(t *testing.T) {
+	oldMail, oldHolds := MailQueue, Holds
+	defer func() { MailQueue, Holds = oldMail, oldHolds }()
+	Holds = NewDeliveryHolds()
+	MailQueue = NewQueue(MAIL_QUEUE_NAME, 10)
+	MailQueue.Paused = Holds.AllHeld
+	MailQueue.IsHeld = func(entry *QueueEntry) bool { return Holds.IsHeld(entry.RecipientDomain) }
+
+	Holds.Hold("Held.example")
+	if !Holds.IsHeld("held.example") || Holds.IsHeld("other.example") || Holds.AllHeld() {
+		t.Errorf("expect only held.example held, got - %+v", Holds.State())
+	}
+	MailQueue.Push(QueueEntry{Id: "1", RecipientDomain: "held.example"})
+	MailQueue.Push(QueueEntry{Id: "2", RecipientDomain: "other.example"})
+	MailQueue.Push(QueueEntry{Id: "3", RecipientDomain: "held.example"})
+
+	if entry := MailQueue.Pop(); entry.Id != "2" {
+		t.Errorf("expect '2' past the held domain, got - '%s'", entry.Id)
+	}
+	popped := make(chan QueueEntry)
+	go func() {
+		for i := 0; i < 2; i++ {
+			popped <- MailQueue.Pop()
+		}
+	}()
+	select {
+	case entry := <-popped:
+		t.Fatalf("expect nothing popped while held.example is held, got - '%s'", entry.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	Holds.Release("held.example")
+	for _, expect := range []string{"1", "3"} {
+		select {
+		case entry := <-popped:
+			if entry.Id != expect {
+				t.Errorf("expect '%s' after release, got - '%s'", expect, entry.Id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect '%s' delivered after release", expect)
+		}
+	}
+}
+
+func TestDeliveryHoldAll(t *testing.T) {
+	oldMail, oldHolds := MailQueue, Holds
+	defer func() { MailQueue, Holds = oldMail, oldHolds }()
+	Holds = NewDeliveryHolds()
+	MailQueue = NewQueue(MAIL_QUEUE_NAME, 10)
+	MailQueue.Paused = Holds.AllHeld
+	MailQueue.IsHeld = func(entry *QueueEntry) bool { return Holds.IsHeld(entry.RecipientDomain) }
+
+	Holds.Hold("")
+	Holds.Hold("held.example")
+	MailQueue.Push(QueueEntry{Id: "1", RecipientDomain: "other.example"})
+	MailQueue.Push(QueueEntry{Id: "2", RecipientDomain: "held.example"})
+	if n := MailQueue.Deliverable(); n != 0 {
+		t.Errorf("expect nothing deliverable under the global hold, got - %d", n)
+	}
+
+	// Lifting the global hold keeps domain holds
+	Holds.Release("")
+	if n := MailQueue.Deliverable(); n != 1 {
+		t.Errorf("expect 1 deliverable entry, got - %d", n)
+	}
+	Holds.ReleaseAll()
+	if state := Holds.State(); state.All || len(state.Domains) != 0 || MailQueue.Deliverable() != 2 {
+		t.Errorf("expect all holds lifted, got - %+v", state)
+	}
+}
@@ -43,6 +43,10 @@ echo "Installing golang LOG4GO package"
 go get "code.google.com/p/log4go"
 echo "Installing golang REDIS package"
 go get "gopkg.in/redis.v2"
+echo "Installing golang BCRYPT package"
+go get "golang.org/x/crypto/bcrypt"
+echo "Installing golang IDNA package"
+go get "golang.org/x/net/idna"
 mkdir $CWD/build/$SYSTEM/bin
 go build -o $CWD/build/$SYSTEM/bin/$APPNAME -i
 export GOPATH=$OLDGOPATH
@@ -89,6 +93,10 @@ echo "Installing golang LOG4GO package"
 go get "code.google.com/p/log4go"
 echo "Installing golang REDIS package"
 go get "gopkg.in/redis.v2"
+echo "Installing golang BCRYPT package"
+go get "golang.org/x/crypto/bcrypt"
+echo "Installing golang IDNA package"
+go get "golang.org/x/net/idna"
 #mkdir $CWD/build/$SYSTEM/bin
 go build -o $CWD/build/$SYSTEM/bin/$APPNAME -i
 export GOPATH=$OLDGOPATH
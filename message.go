@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"smtprelay/uuid"
+	"io"
 	"net/mail"
+	"smtprelay/smtpd"
+	"smtprelay/spool"
+	"smtprelay/uuid"
 	"strings"
+	"time"
 )
 
 type EmailAddress struct {
@@ -21,6 +25,7 @@ type Msg struct {
 	Sender      EmailAddress
 	RcptDomains map[string]int
 	MessageId   string
+	QueueId     string
 	Message     mail.Message
 }
 
@@ -29,18 +34,23 @@ func (msg *Msg) String() string {
 	for _, s := range msg.Rcpt {
 		rcpt += s.Address + ";"
 	}
+	if msg.QueueId != "" {
+		return fmt.Sprintf("(id:%s;message-id:%s;from:%s;to:%s)", msg.QueueId, msg.MessageId, msg.Sender.Address, rcpt)
+	}
 	return fmt.Sprintf("(message-id:%s;from:%s;to:%s)", msg.MessageId, msg.Sender.Address, rcpt)
 }
 
 func ParseDomain(addr string) (domain string, err error) {
 	var parts = strings.Split(addr, "@")
-	if len(parts) == 0 || len(parts) > 2 {
+	if len(parts) != 2 {
 		return "", errors.New("illegal addr " + addr)
 	}
 	return parts[1], nil
 }
 
-func ParseMessage(recipients []string, sender string, data []byte) (msg Msg, err error) {
+// ParseMessage parses the envelope addresses and the message header read
+// from data. The message body is not read.
+func ParseMessage(recipients []string, sender string, data io.Reader) (msg Msg, err error) {
 
 	msg.Sender, err = ParseAddress(sender)
 	if err != nil {
@@ -53,7 +63,7 @@ func ParseMessage(recipients []string, sender string, data []byte) (msg Msg, err
 		}
 		msg.Rcpt = append(msg.Rcpt, rcptAddr)
 	}
-	message, err := mail.ReadMessage(bytes.NewReader(data))
+	message, err := mail.ReadMessage(data)
 	if err != nil {
 		return msg, err
 	}
@@ -61,9 +71,7 @@ func ParseMessage(recipients []string, sender string, data []byte) (msg Msg, err
 
 	msg.MessageId = msg.Message.Header.Get("message-id")
 	if msg.MessageId == "" {
-		id := uuid.NewV4()
-		uuid.SwitchFormat(uuid.Clean)
-		msg.MessageId = id.String()
+		msg.MessageId = NewMessageId()
 	}
 
 	msg.RcptDomains = make(map[string]int)
@@ -73,6 +81,63 @@ func ParseMessage(recipients []string, sender string, data []byte) (msg Msg, err
 	return msg, nil
 }
 
+// NewMessageId returns a Message-ID for a message that came without one
+func NewMessageId() string {
+	return "<" + uuid.Formatter(uuid.NewV4(), uuid.Clean) + "@" + conf.ServerHostName + ">"
+}
+
+// AddMissingHeaders adds the Message-ID and Date headers to a message that
+// lacks them and keeps msg.MessageId, the ID the message is tracked by, in
+// line with its header after the header rules: a replaced Message-ID is
+// tracked by its new value, a removed one gets a new ID.
+func AddMissingHeaders(body *spool.Body, msg *Msg) error {
+	data, err := body.Open()
+	if err != nil {
+		return err
+	}
+	fields, eol, _, err := readHeaderFields(data)
+	data.Close()
+	if err != nil {
+		return err
+	}
+	hasMessageId, hasDate := false, false
+	for _, f := range fields {
+		switch f.key {
+		case "Message-Id":
+			if !hasMessageId {
+				msg.MessageId = fieldValue(f)
+			}
+			hasMessageId = true
+		case "Date":
+			hasDate = true
+		}
+	}
+	var headers bytes.Buffer
+	if !hasMessageId {
+		if msg.Message.Header.Get("Message-Id") != "" {
+			msg.MessageId = NewMessageId()
+		}
+		fmt.Fprintf(&headers, "Message-ID: %s%s", msg.MessageId, eol)
+	}
+	if !hasDate {
+		fmt.Fprintf(&headers, "Date: %s%s", time.Now().Format(time.RFC1123Z), eol)
+	}
+	if headers.Len() > 0 {
+		body.Prepend(headers.Bytes())
+	}
+	return nil
+}
+
+// ParseMessageBody is ParseMessage for a spooled body
+func ParseMessageBody(recipients []string, sender string, body *spool.Body) (msg Msg, err error) {
+	data, err := body.Open()
+	if err != nil {
+		return msg, err
+	}
+	defer data.Close()
+	return ParseMessage(recipients, sender, data)
+}
+
 func ParseAddress(rawAddress string) (address EmailAddress, err error) {
 	addr, err := mail.ParseAddress(rawAddress)
 	if err != nil {
@@ -88,6 +153,30 @@ func ParseAddress(rawAddress string) (address EmailAddress, err error) {
 	return address, nil
 }
 
+// NeedsSMTPUTF8 reports whether the envelope addresses or the header can
+// only be relayed with SMTPUTF8
+func (msg *Msg) NeedsSMTPUTF8() bool {
+	if !smtpd.IsASCII(msg.Sender.Address) {
+		return true
+	}
+	for _, rcpt := range msg.Rcpt {
+		if !smtpd.IsASCII(rcpt.Address) {
+			return true
+		}
+	}
+	for name, values := range msg.Message.Header {
+		if !smtpd.IsASCII(name) {
+			return true
+		}
+		for _, value := range values {
+			if !smtpd.IsASCII(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (msg *Msg) GetDomainRecipientList(domain string) (recipients []string) {
 	for _, rcpt := range msg.Rcpt {
 		if strings.EqualFold(domain, rcpt.Domain) {
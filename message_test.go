@@ -0,0 +1,124 @@
+package main
+
+import (
+	"smtprelay/spool"
+	"strings"
+	"testing"
+)
+
+func TestParseDomain(t *testing.T) {
+	domain, err := ParseDomain("ünïcode@Bücher.de")
+	if err != nil || domain != "Bücher.de" {
+		t.Errorf("expect 'Bücher.de', got - '%s' (%v)", domain, err)
+	}
+	for _, addr := range []string{"no-at-sign", "a@b@c"} {
+		if _, err := ParseDomain(addr); err == nil {
+			t.Errorf("expect error for '%s'", addr)
+		}
+	}
+}
+
+func TestParseMessageSMTPUTF8(t *testing.T) {
+	conf = &Conf{ServerHostName: "relay.example.net"}
+	data := "From: sender@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+	msg, err := ParseMessage([]string{"<a@example.com>"}, "<sender@example.com>", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if msg.NeedsSMTPUTF8() {
+		t.Errorf("expect ASCII message not to need SMTPUTF8")
+	}
+
+	msg, err = ParseMessage([]string{"<a@example.com>", "<пользователь@пример.рф>"}, "<sender@example.com>", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !msg.NeedsSMTPUTF8() {
+		t.Errorf("expect UTF-8 recipient to need SMTPUTF8")
+	}
+	if msg.RcptDomains["пример.рф"] != 1 {
+		t.Errorf("expect 1 recipient for 'пример.рф', got - %d", msg.RcptDomains["пример.рф"])
+	}
+
+	data = "From: Jürgen <sender@example.com>\r\nSubject: test\r\n\r\nbody\r\n"
+	msg, err = ParseMessage([]string{"<a@example.com>"}, "<sender@example.com>", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !msg.NeedsSMTPUTF8() {
+		t.Errorf("expect UTF-8 header to need SMTPUTF8")
+	}
+}
+
+func TestAddMissingHeaders(t *testing.T) {
+	conf = &Conf{ServerHostName: "relay.example.net"}
+	data := "From: sender@example.com\nSubject: test\n\nbody\n"
+
+	msg, err := ParseMessage([]string{"<a@example.com>"}, "<sender@example.com>", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !strings.HasPrefix(msg.MessageId, "<") || !strings.HasSuffix(msg.MessageId, "@relay.example.net>") {
+		t.Errorf("expect generated Message-ID at relay.example.net, got - '%s'", msg.MessageId)
+	}
+
+	body := spool.NewBody([]byte(data))
+	generated := msg.MessageId
+	if err := AddMissingHeaders(body, &msg); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	got, _ := body.Bytes()
+	if msg.MessageId != generated || !strings.HasPrefix(string(got), "Message-ID: "+generated+"\nDate: ") || !strings.HasSuffix(string(got), "\n"+data) {
+		t.Errorf("expect Message-ID and Date added, got - '%s'", got)
+	}
+
+	data = "Message-ID: <1@example.com>\r\nDate: Mon, 1 Jan 2018 00:00:00 +0000\r\n\r\nbody\r\n"
+	msg, _ = ParseMessage([]string{"<a@example.com>"}, "<sender@example.com>", strings.NewReader(data))
+	body = spool.NewBody([]byte(data))
+	if err := AddMissingHeaders(body, &msg); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if got, _ := body.Bytes(); string(got) != data || msg.MessageId != "<1@example.com>" {
+		t.Errorf("expect '%s', got - '%s'", data, got)
+	}
+}
+
+func TestAddMissingHeadersAfterRules(t *testing.T) {
+	conf = &Conf{ServerHostName: "relay.example.net"}
+	data := "Message-ID: <bad id>\r\nDate: Mon, 1 Jan 2018 00:00:00 +0000\r\n\r\nbody\r\n"
+	msg, err := ParseMessage([]string{"<a@example.com>"}, "<sender@example.com>", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// A removed Message-ID is replaced by a new one, not put back
+	body := spool.NewBody([]byte(data))
+	if err := RemoveHeader(body, "Message-ID"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := AddMissingHeaders(body, &msg); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	got, _ := body.Bytes()
+	if msg.MessageId == "<bad id>" || !strings.HasPrefix(string(got), "Message-ID: "+msg.MessageId+"\r\nDate: ") {
+		t.Errorf("expect a new Message-ID tracked and added, got '%s' - '%s'", msg.MessageId, got)
+	}
+
+	// A replaced Message-ID is tracked by its new value
+	msg, _ = ParseMessage([]string{"<a@example.com>"}, "<sender@example.com>", strings.NewReader(data))
+	body = spool.NewBody([]byte(data))
+	rule, err := NewHeaderRule(HeaderRuleConf{Action: HEADER_RULE_REPLACE, Header: "Message-ID", Value: "<2@example.com>"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := applyHeaderRules(body, []*HeaderRule{rule}, HeaderContext{}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := AddMissingHeaders(body, &msg); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if msg.MessageId != "<2@example.com>" {
+		t.Errorf("expect '<2@example.com>' tracked, got - '%s'", msg.MessageId)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"smtprelay/metrics"
+)
+
+const (
+	DELIVERY_RESULT_SENT     = "sent"
+	DELIVERY_RESULT_DEFERRED = "deferred"
+	DELIVERY_RESULT_DROPPED  = "dropped"
+
+	LISTENER_SMTP = "smtp"
+	LISTENER_TCP  = "tcp"
+)
+
+var (
+	Metrics = metrics.NewRegistry()
+
+	DeliveriesCounter = Metrics.NewCounterVec("smtprelay_deliveries_total",
+		"Outgoing delivery attempts by result, SMTP status class and destination domain.",
+		"result", "status_class", "domain")
+	DeliveryDuration = Metrics.NewHistogramVec("smtprelay_delivery_duration_seconds",
+		"Duration of outgoing SMTP transactions.",
+		nil, "result")
+	DeliveryRetriesCounter = Metrics.NewCounterVec("smtprelay_delivery_retries_total",
+		"Delivery attempts of previously deferred messages by destination domain.",
+		"domain")
+	DKIMSignFailuresCounter = Metrics.NewCounterVec("smtprelay_dkim_sign_failures_total",
+		"Messages sent unsigned because DKIM signing failed, by sender domain.",
+		"domain")
+	InboundSessionsCounter = Metrics.NewCounterVec("smtprelay_inbound_sessions_total",
+		"Accepted inbound connections by listener.",
+		"listener")
+	RateLimitedCounter = Metrics.NewCounterVec("smtprelay_rate_limited_total",
+		"Messages refused by an intake rate limit, by limit.",
+		"limit")
+	DNSLookupDuration = Metrics.NewHistogramVec("smtprelay_dns_lookup_duration_seconds",
+		"Duration of DNS lookups by record type and result.",
+		[]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "type", "result")
+)
+
+func init() {
+	Metrics.NewGaugeFunc("smtprelay_mail_queue_depth", "Messages waiting in the mail queue.", func() float64 {
+		if MailQueue == nil {
+			return 0
+		}
+		return float64(MailQueue.Len())
+	})
+	Metrics.NewGaugeFunc("smtprelay_deferred_queue_depth", "Messages waiting in the deferred queue.", func() float64 {
+		if ErrorQueue == nil {
+			return 0
+		}
+		return float64(ErrorQueue.Len())
+	})
+	Metrics.NewGaugeFunc("smtprelay_scheduled_queue_depth", "Messages waiting for their send-after time.", func() float64 {
+		if ScheduledQueue == nil {
+			return 0
+		}
+		return float64(ScheduledQueue.Len())
+	})
+	Metrics.NewGaugeFunc("smtprelay_intake_throttled", "1 while new messages are refused because the queue is near capacity.", func() float64 {
+		if MailQueue == nil || !IntakeThrottled() {
+			return 0
+		}
+		return 1
+	})
+	Metrics.NewGaugeFunc("smtprelay_outbound_connections", "Outgoing SMTP connections in progress.", func() float64 {
+		return float64(len(SenderLimiter))
+	})
+}
+
+// StatusClass returns the SMTP status class of code, e.g. "4xx"
+func StatusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
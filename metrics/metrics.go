@@ -0,0 +1,277 @@
+// Package metrics implements counters, gauges and histograms with optional
+// labels and writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds registered metrics in registration order
+type Registry struct {
+	sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.Lock()
+	defer r.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes all metrics in the text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry over HTTP
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.Write(w)
+	}
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+}
+
+// labelPairs formats {k="v",...}, with extra appended after the metric labels
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	for i, l := range d.labels {
+		pairs = append(pairs, l+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// vec keeps one child per distinct label value combination
+type vec struct {
+	desc
+	sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+	create   func() interface{}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.RLock()
+	child, ok := v.children[key]
+	v.RUnlock()
+	if ok {
+		return child
+	}
+	v.Lock()
+	defer v.Unlock()
+	if child, ok = v.children[key]; !ok {
+		child = v.create()
+		v.children[key] = child
+		v.values[key] = append([]string(nil), values...)
+	}
+	return child
+}
+
+// each calls fn for every child, ordered by label values
+func (v *vec) each(fn func(values []string, child interface{})) {
+	v.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]interface{}, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+		values[i] = v.values[k]
+	}
+	v.RUnlock()
+	for i := range keys {
+		fn(values[i], children[i])
+	}
+}
+
+func newVec(name, help, kind string, labels []string, create func() interface{}) *vec {
+	return &vec{
+		desc:     desc{name: name, help: help, kind: kind, labels: labels},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		create:   create,
+	}
+}
+
+// Counter is a monotonically increasing integer counter
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc()          { atomic.AddUint64(&c.value, 1) }
+func (c *Counter) Add(n uint64)  { atomic.AddUint64(&c.value, n) }
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.value) }
+
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec registers a counter partitioned by labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() interface{} { return &Counter{} })}
+	r.register(name, c)
+	return c
+}
+
+// With returns the counter for the given label values
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	c.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, c.labelPairs(values), child.(*Counter).Value())
+	})
+}
+
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &gaugeFunc{desc{name: name, help: help, kind: "gauge"}, fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	sync.Mutex
+	upper  []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, upper := range h.upper {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+// NewHistogramVec registers a histogram partitioned by labels. Buckets
+// must be sorted in increasing order; DefBuckets is used if nil.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &HistogramVec{newVec(name, help, "histogram", labels, func() interface{} {
+		return &Histogram{upper: buckets, counts: make([]uint64, len(buckets))}
+	})}
+	r.register(name, h)
+	return h
+}
+
+// With returns the histogram for the given label values
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	h.each(func(values []string, child interface{}) {
+		hist := child.(*Histogram)
+		hist.Lock()
+		for i, upper := range hist.upper {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", formatFloat(upper)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(values), hist.count)
+		hist.Unlock()
+	})
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
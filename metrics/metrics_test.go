@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Test counter.", "result", "domain")
+	c.With("sent", "example.com").Inc()
+	c.With("sent", "example.com").Add(2)
+	c.With("dropped", `ex"ample`).Inc()
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	expect := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{result="dropped",domain="ex\"ample"} 1
+test_total{result="sent",domain="example.com"} 3
+`
+	if buf.String() != expect {
+		t.Errorf("expect '%s', got - '%s'", expect, buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("test_seconds", "Test histogram.", []float64{1, 5}, "type")
+	h.With("mx").Observe(0.5)
+	h.With("mx").Observe(3)
+	h.With("mx").Observe(10)
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	for _, line := range []string{
+		`test_seconds_bucket{type="mx",le="1"} 1`,
+		`test_seconds_bucket{type="mx",le="5"} 2`,
+		`test_seconds_bucket{type="mx",le="+Inf"} 3`,
+		`test_seconds_sum{type="mx"} 13.5`,
+		`test_seconds_count{type="mx"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expect line '%s' in output '%s'", line, buf.String())
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("test_depth", "Test gauge.", func() float64 { return 42 })
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	if !strings.HasSuffix(buf.String(), "test_depth 42\n") {
+		t.Errorf("expect gauge value 42, got - '%s'", buf.String())
+	}
+}
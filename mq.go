@@ -1,76 +1,581 @@
 package main
 
 import (
+	"container/list"
 	"fmt"
+	"math/rand"
 	"smtprelay/smtpd"
+	"smtprelay/spool"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const MAX_ERROR_BUFFER_SIZE = 1000000
 const MAX_MAIL_BUFFER_SIZE = 1000000
+const MAX_SCHEDULED_BUFFER_SIZE = 1000000
+
+const (
+	MAIL_QUEUE_NAME      = "mail"
+	ERROR_QUEUE_NAME     = "deferred"
+	SCHEDULED_QUEUE_NAME = "scheduled"
+)
 
 var (
-	MailChannel  chan QueueEntry
-	ErrorChannel chan QueueEntry
+	MailQueue      *Queue
+	ErrorQueue     *Queue
+	ScheduledQueue *Queue
 )
 
 type QueueEntry struct {
+	Id              string
+	QueueId         string // Queue ID of the accepted message, shared by its entries
 	MailServer      string
 	Sender          string
 	Recipients      []string
 	SenderDomain    string
 	RecipientDomain string
 	MessageId       string
-	Data            []byte
+	AuthUser        string
+	Body            *spool.Body    `json:"-"`
+	Signature       *DKIMSignature `json:"-"` // Shared by the entries of a message
+	BodyType        string
+	SMTPUTF8        bool
+	Ret             string
+	EnvID           string
+	DSN             map[string]smtpd.RecipientDSN
+	Priority        int
+	SendAfter       time.Time // Not delivered before, if set
+	CampaignId      string
 	Error           smtpd.Error
 	ErrorCount      int
+	Held            bool
+	ReceivedTime    time.Time
 	QueueTime       time.Time
 	UnqueueTime     time.Time
+	parked          bool // In the held list of its queue
 }
 
 func (e QueueEntry) String() string {
-	return fmt.Sprintf("(message-id:%s;from:%s;to:%s)", e.MessageId, e.Sender, strings.Join(e.Recipients, ";"))
+	return fmt.Sprintf("(id:%s;message-id:%s;from:%s;to:%s)", e.Id, e.MessageId, e.Sender, strings.Join(e.Recipients, ";"))
+}
+
+// QueueFilter selects queue entries. Empty fields match everything. Id
+// matches an entry ID or the queue ID shared by the entries of a message.
+type QueueFilter struct {
+	Id       string
+	Domain   string
+	Sender   string
+	Campaign string
+	MinAge   time.Duration
+}
+
+func (f QueueFilter) IsEmpty() bool {
+	return f.Id == "" && f.Domain == "" && f.Sender == "" && f.Campaign == "" && f.MinAge == 0
+}
+
+func (f QueueFilter) Match(entry *QueueEntry, now time.Time) bool {
+	if f.Id != "" && f.Id != entry.Id && f.Id != entry.QueueId {
+		return false
+	}
+	if f.Domain != "" && !strings.EqualFold(f.Domain, entry.RecipientDomain) {
+		return false
+	}
+	if f.Sender != "" {
+		if strings.Contains(f.Sender, "@") {
+			if !strings.EqualFold(f.Sender, entry.Sender) {
+				return false
+			}
+		} else if !strings.EqualFold(f.Sender, entry.SenderDomain) {
+			return false
+		}
+	}
+	if f.Campaign != "" && f.Campaign != entry.CampaignId {
+		return false
+	}
+	if f.MinAge > 0 && now.Sub(entry.ReceivedTime) < f.MinAge {
+		return false
+	}
+	return true
+}
+
+// Queue is an indexed FIFO of queue entries per priority. Pop skips entries
+// whose UnqueueTime is in the future and sets held entries aside in a list of
+// their own until they are released, so entries can be inspected, held or
+// removed while they wait without being scanned on every Pop.
+type Queue struct {
+	sync.Mutex
+	Name string
+	// Optional hooks consulted by Pop. While Paused returns true nothing is
+	// popped; entries for which IsHeld returns true are set aside until
+	// Unpark.
+	Paused func() bool
+	IsHeld func(entry *QueueEntry) bool
+	// Keep each priority sorted by UnqueueTime, so Pop stops at the first
+	// entry that isn't due yet instead of scanning the whole queue
+	Ordered bool
+	levels  []*list.List // By priorityLevel
+	held    *list.List   // Entries set aside by Pop while they are held
+	credits []int        // Entries each level may still take in this round
+	index   map[string]*list.Element
+	slots   chan struct{}
+	wakeup  chan struct{}
+}
+
+func NewQueue(name string, size int) *Queue {
+	q := &Queue{
+		Name:    name,
+		credits: make([]int, len(priorityWeights)),
+		held:    list.New(),
+		index:   make(map[string]*list.Element),
+		slots:   make(chan struct{}, size),
+		wakeup:  make(chan struct{}, 1),
+	}
+	for range priorityWeights {
+		q.levels = append(q.levels, list.New())
+	}
+	return q
+}
+
+// each calls fn for the entries from the highest priority down, in queue
+// order within a priority, and then for the held entries set aside by Pop.
+// fn may remove the element it is given. Must be called with the lock held.
+func (q *Queue) each(fn func(el *list.Element)) {
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		for el := q.levels[i].Front(); el != nil; {
+			next := el.Next()
+			fn(el)
+			el = next
+		}
+	}
+	for el := q.held.Front(); el != nil; {
+		next := el.Next()
+		fn(el)
+		el = next
+	}
+}
+
+// must be called with the lock held
+func (q *Queue) isHeld(entry *QueueEntry) bool {
+	return entry.Held || (q.IsHeld != nil && q.IsHeld(entry))
+}
+
+// insert adds entry to the list of its priority, sorted by UnqueueTime if the
+// queue is Ordered. Must be called with the lock held.
+func (q *Queue) insert(entry *QueueEntry) {
+	entry.parked = false
+	entries := q.levels[priorityLevel(entry.Priority)]
+	if !q.Ordered {
+		q.index[entry.Id] = entries.PushBack(entry)
+		return
+	}
+	el := entries.Back()
+	for el != nil && el.Value.(*QueueEntry).UnqueueTime.After(entry.UnqueueTime) {
+		el = el.Prev()
+	}
+	if el == nil {
+		q.index[entry.Id] = entries.PushFront(entry)
+	} else {
+		q.index[entry.Id] = entries.InsertAfter(entry, el)
+	}
+}
+
+// park moves a held entry to the held list. Must be called with the lock
+// held.
+func (q *Queue) park(el *list.Element) {
+	entry := el.Value.(*QueueEntry)
+	q.levels[priorityLevel(entry.Priority)].Remove(el)
+	entry.parked = true
+	q.index[entry.Id] = q.held.PushBack(entry)
+}
+
+// unpark moves a held entry that is no longer held back to its priority.
+// Must be called with the lock held.
+func (q *Queue) unpark(el *list.Element) bool {
+	entry := el.Value.(*QueueEntry)
+	if !entry.parked || q.isHeld(entry) {
+		return false
+	}
+	q.held.Remove(el)
+	q.insert(entry)
+	return true
+}
+
+// Unpark puts the held entries that were released back in the queue, e.g.
+// after a domain hold is lifted.
+func (q *Queue) Unpark() {
+	q.Lock()
+	for el := q.held.Front(); el != nil; {
+		next := el.Next()
+		q.unpark(el)
+		el = next
+	}
+	q.Unlock()
+	q.Notify()
+}
+
+// Push appends entry to the queue, blocking while the queue is full.
+func (q *Queue) Push(entry QueueEntry) {
+	q.slots <- struct{}{}
+	q.add(entry)
+}
+
+// TryPush is Push without blocking; it reports whether there was room
+// for entry.
+func (q *Queue) TryPush(entry QueueEntry) bool {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		return false
+	}
+	q.add(entry)
+	return true
+}
+
+// add queues entry into a slot the caller has taken
+func (q *Queue) add(entry QueueEntry) {
+	q.Lock()
+	if entry.Id == "" {
+		entry.Id = NewQueueId()
+	}
+	for {
+		if _, found := q.index[entry.Id]; !found {
+			break
+		}
+		id := NewQueueId()
+		log.Error("SYSTEM: %s queue already has entry %s, queued as %s instead", q.Name, entry.Id, id)
+		entry.Id = id
+	}
+	if entry.ReceivedTime.IsZero() {
+		entry.ReceivedTime = time.Now()
+	}
+	q.insert(&entry)
+	q.Unlock()
+	q.Notify()
+}
+
+// Pop removes and returns the first entry ready for delivery, blocking until
+// there is one. Priorities take turns by priorityWeights, so higher ones go
+// first without starving the lower ones.
+func (q *Queue) Pop() QueueEntry {
+	for {
+		if q.Paused != nil && q.Paused() {
+			q.wait(time.Time{})
+			continue
+		}
+		q.Lock()
+		now := time.Now()
+		var next time.Time
+		ready := make([]*list.Element, len(q.levels))
+		for i, entries := range q.levels {
+			for el := entries.Front(); el != nil; {
+				entry := el.Value.(*QueueEntry)
+				if q.isHeld(entry) {
+					held := el
+					el = el.Next()
+					q.park(held)
+					continue
+				}
+				if entry.UnqueueTime.After(now) {
+					if next.IsZero() || entry.UnqueueTime.Before(next) {
+						next = entry.UnqueueTime
+					}
+					if q.Ordered {
+						break
+					}
+					el = el.Next()
+					continue
+				}
+				ready[i] = el
+				break
+			}
+		}
+		if level := q.nextLevel(ready); level >= 0 {
+			entry := q.remove(ready[level])
+			q.Unlock()
+			return *entry
+		}
+		q.Unlock()
+		q.wait(next)
+	}
+}
+
+// nextLevel picks the highest priority with a ready entry and credit left,
+// starting a new round when none has credit. Returns -1 if nothing is
+// ready. Must be called with the lock held.
+func (q *Queue) nextLevel(ready []*list.Element) int {
+	for round := 0; round < 2; round++ {
+		for i := len(ready) - 1; i >= 0; i-- {
+			if ready[i] != nil && q.credits[i] > 0 {
+				q.credits[i]--
+				return i
+			}
+		}
+		copy(q.credits, priorityWeights)
+	}
+	return -1
+}
+
+func (q *Queue) wait(until time.Time) {
+	if until.IsZero() {
+		<-q.wakeup
+		return
+	}
+	timer := time.NewTimer(until.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-q.wakeup:
+	case <-timer.C:
+	}
+}
+
+// Notify wakes up a blocked Pop so it rescans the queue.
+func (q *Queue) Notify() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// must be called with the lock held
+func (q *Queue) remove(el *list.Element) *QueueEntry {
+	entry := el.Value.(*QueueEntry)
+	if entry.parked {
+		q.held.Remove(el)
+	} else {
+		q.levels[priorityLevel(entry.Priority)].Remove(el)
+	}
+	delete(q.index, entry.Id)
+	<-q.slots
+	return entry
+}
+
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.index)
+}
+
+func (q *Queue) Get(id string) (entry QueueEntry, found bool) {
+	q.Lock()
+	defer q.Unlock()
+	el, found := q.index[id]
+	if !found {
+		return entry, false
+	}
+	return *el.Value.(*QueueEntry), true
+}
+
+// Find returns copies of all entries matching filter in queue order.
+func (q *Queue) Find(filter QueueFilter) (entries []QueueEntry) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	if el, found := q.index[filter.Id]; found {
+		if filter.Match(el.Value.(*QueueEntry), now) {
+			entries = append(entries, *el.Value.(*QueueEntry))
+		}
+		return
+	}
+	q.each(func(el *list.Element) {
+		if entry := el.Value.(*QueueEntry); filter.Match(entry, now) {
+			entries = append(entries, *entry)
+		}
+	})
+	return
+}
+
+// Deliverable counts the entries Pop would return sooner or later, those
+// that aren't held.
+func (q *Queue) Deliverable() (count int) {
+	if q.Paused != nil && q.Paused() {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.each(func(el *list.Element) {
+		if !q.isHeld(el.Value.(*QueueEntry)) {
+			count++
+		}
+	})
+	return
+}
+
+// CountBy counts the entries by the key fn returns for them; empty keys
+// aren't counted.
+func (q *Queue) CountBy(fn func(entry *QueueEntry) string) map[string]int64 {
+	q.Lock()
+	defer q.Unlock()
+	counts := make(map[string]int64)
+	q.each(func(el *list.Element) {
+		if key := fn(el.Value.(*QueueEntry)); key != "" {
+			counts[key]++
+		}
+	})
+	return counts
+}
+
+// Remove takes all entries matching filter out of the queue and returns them.
+func (q *Queue) Remove(filter QueueFilter) (entries []QueueEntry) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	q.each(func(el *list.Element) {
+		if filter.Match(el.Value.(*QueueEntry), now) {
+			entries = append(entries, *q.remove(el))
+		}
+	})
+	return
+}
+
+// Update calls fn for every entry matching filter and returns the number of
+// entries touched. Held entries fn releases go back in the queue.
+func (q *Queue) Update(filter QueueFilter, fn func(entry *QueueEntry)) (count int) {
+	q.Lock()
+	now := time.Now()
+	q.each(func(el *list.Element) {
+		if entry := el.Value.(*QueueEntry); filter.Match(entry, now) {
+			fn(entry)
+			q.unpark(el)
+			count++
+		}
+	})
+	q.Unlock()
+	if count > 0 {
+		q.Notify()
+	}
+	return
+}
+
+// The counter starts at a random value, so a restarted relay doesn't hand
+// out the IDs of the previous process again within the same microsecond
+var queueIdCounter = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+
+// NewQueueId returns a queue ID for an accepted message: the time in
+// microseconds and a counter, in fixed width hex, so IDs sort by arrival.
+func NewQueueId() string {
+	n := atomic.AddUint32(&queueIdCounter, 1) & 0xffffff
+	return fmt.Sprintf("%014X%06X", time.Now().UnixNano()/int64(time.Microsecond), n)
+}
+
+// SubQueueId returns the ID of the n-th queue entry, one per recipient
+// domain, of the message accepted as queueId
+func SubQueueId(queueId string, n int) string {
+	return queueId + "." + strconv.Itoa(n)
 }
 
 func InitQueues() error {
-	MailChannel = make(chan QueueEntry, MAX_MAIL_BUFFER_SIZE)
-	ErrorChannel = make(chan QueueEntry, MAX_ERROR_BUFFER_SIZE)
+	MailQueue = NewQueue(MAIL_QUEUE_NAME, MAX_MAIL_BUFFER_SIZE)
+	ErrorQueue = NewQueue(ERROR_QUEUE_NAME, MAX_ERROR_BUFFER_SIZE)
+	ErrorQueue.Ordered = true
+	ScheduledQueue = NewQueue(SCHEDULED_QUEUE_NAME, MAX_SCHEDULED_BUFFER_SIZE)
+	ScheduledQueue.Ordered = true
 
 	return nil
 }
 
+// PushMail queues entry for delivery, or keeps it in the scheduled queue
+// until its UnqueueTime if that is in the future
 func PushMail(entry QueueEntry) {
 	MailQueueCheckMax()
-	MailChannel <- entry
+	if entry.UnqueueTime.After(time.Now()) {
+		ScheduledQueue.Push(entry)
+		return
+	}
+	MailQueue.Push(entry)
 	return
 }
 
+// TryPushMail is PushMail for callers that must not block on a full queue;
+// it reports whether entry was queued.
+func TryPushMail(entry QueueEntry) bool {
+	MailQueueCheckMax()
+	if entry.UnqueueTime.After(time.Now()) {
+		return ScheduledQueue.TryPush(entry)
+	}
+	return MailQueue.TryPush(entry)
+}
+
 func PopMail() (entry QueueEntry) {
-	entry = <-MailChannel
+	entry = MailQueue.Pop()
 	return
 }
 
 func PushError(entry QueueEntry) {
 	MailQueueCheckMax()
-	ErrorChannel <- entry
+	ErrorQueue.Push(entry)
 	return
 }
 
 func ExtractError() (entry QueueEntry) {
+	return ErrorQueue.Pop()
+}
 
-	entry = <-ErrorChannel
-	for entry.UnqueueTime.After(time.Now()) {
-		time.Sleep(1 * time.Second)
-	}
-	return entry
+func ExtractScheduled() (entry QueueEntry) {
+	return ScheduledQueue.Pop()
 }
 
 func FlushErrors() {
-	for len(ErrorChannel) > 0 {
-		entry := <-ErrorChannel
+	for _, entry := range ErrorQueue.Remove(QueueFilter{}) {
 		log.Error("msg %s FLUSHED from error queue. Error counter is forced to %d", entry.String(), entry.ErrorCount)
 		entry.ErrorCount = conf.DeferredMailMaxErrors
-		MailChannel <- entry
+		entry.UnqueueTime = time.Time{}
+		MailQueue.Push(entry)
+	}
+}
+
+// RetryMail moves deferred entries matching filter back to the mail queue
+// for an immediate attempt.
+func RetryMail(filter QueueFilter) (count int) {
+	for _, entry := range ErrorQueue.Remove(filter) {
+		log.Info("msg %s RETRY forced from error queue (%d/%d)", entry.String(), entry.ErrorCount, conf.DeferredMailMaxErrors)
+		entry.UnqueueTime = time.Time{}
+		MailQueue.Push(entry)
+		count++
+	}
+	return
+}
+
+// DeleteMail drops entries matching filter from all queues.
+func DeleteMail(filter QueueFilter) (count int) {
+	for _, q := range []*Queue{MailQueue, ErrorQueue, ScheduledQueue} {
+		for _, entry := range q.Remove(filter) {
+			log.Error("msg %s DELETED from %s queue", entry.String(), q.Name)
+			Campaigns.Record(entry.CampaignId, entry.Id, CAMPAIGN_RESULT_DELETED)
+			entry.Body.Release()
+			MailDroppedIncreaseCounter(1)
+			count++
+		}
+	}
+	return
+}
+
+// HoldMail sets or clears the hold flag on entries matching filter in all
+// queues. Held entries stay queued but are never popped.
+func HoldMail(filter QueueFilter, held bool) (count int) {
+	for _, q := range []*Queue{MailQueue, ErrorQueue, ScheduledQueue} {
+		count += q.Update(filter, func(entry *QueueEntry) {
+			entry.Held = held
+		})
+	}
+	return
+}
+
+// ScheduleMail sets the time entries matching filter in the mail and
+// scheduled queues are sent after; a zero time sends them right away.
+func ScheduleMail(filter QueueFilter, sendAfter time.Time) (count int) {
+	entries := append(ScheduledQueue.Remove(filter), MailQueue.Remove(filter)...)
+	for _, entry := range entries {
+		if sendAfter.IsZero() {
+			log.Info("msg %s UNSCHEDULED, sending now", entry.String())
+		} else {
+			log.Info("msg %s SCHEDULED after %s", entry.String(), sendAfter.Format(time.RFC3339))
+		}
+		entry.SendAfter = sendAfter
+		entry.UnqueueTime = sendAfter
+		PushMail(entry)
 	}
+	return len(entries)
 }
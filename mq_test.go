@@ -0,0 +1,239 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueuePopSkipsHeldAndDelayed(t *testing.T) {
+	q := NewQueue("test", 10)
+	q.Push(QueueEntry{Id: "held", RecipientDomain: "a.com", Held: true})
+	q.Push(QueueEntry{Id: "later", RecipientDomain: "b.com", UnqueueTime: time.Now().Add(time.Hour)})
+	q.Push(QueueEntry{Id: "ready", RecipientDomain: "c.com"})
+
+	entry := q.Pop()
+	if entry.Id != "ready" {
+		t.Errorf("expect 'ready', got - '%s'", entry.Id)
+	}
+	if l := q.Len(); l != 2 {
+		t.Errorf("expect 2 entries left, got - %d", l)
+	}
+
+	if n := q.Update(QueueFilter{Domain: "A.COM"}, func(e *QueueEntry) { e.Held = false }); n != 1 {
+		t.Errorf("expect 1 entry released, got - %d", n)
+	}
+	entry = q.Pop()
+	if entry.Id != "held" {
+		t.Errorf("expect 'held', got - '%s'", entry.Id)
+	}
+}
+
+func TestQueueParksHeldDomains(t *testing.T) {
+	q := NewQueue("test", 10)
+	held := map[string]bool{"a.com": true}
+	q.IsHeld = func(entry *QueueEntry) bool { return held[entry.RecipientDomain] }
+	q.Push(QueueEntry{Id: "a1", RecipientDomain: "a.com"})
+	q.Push(QueueEntry{Id: "a2", RecipientDomain: "a.com"})
+	q.Push(QueueEntry{Id: "b", RecipientDomain: "b.com"})
+
+	if entry := q.Pop(); entry.Id != "b" {
+		t.Errorf("expect 'b', got - '%s'", entry.Id)
+	}
+	if q.held.Len() != 2 || q.levels[priorityLevel(PRIORITY_NORMAL)].Len() != 0 {
+		t.Errorf("expect held entries set aside, got %d held", q.held.Len())
+	}
+	if found := q.Find(QueueFilter{Domain: "a.com"}); len(found) != 2 {
+		t.Errorf("expect held entries found, got - %v", found)
+	}
+	if n := q.Deliverable(); n != 0 {
+		t.Errorf("expect no deliverable entries while a.com is held, got - %d", n)
+	}
+	if removed := q.Remove(QueueFilter{Id: "a2"}); len(removed) != 1 || q.Len() != 1 {
+		t.Errorf("expect held entry removed, got - %v", removed)
+	}
+
+	q.Unpark()
+	if q.held.Len() != 1 {
+		t.Errorf("expect entry kept aside while its domain is held")
+	}
+	delete(held, "a.com")
+	q.Unpark()
+	if entry := q.Pop(); entry.Id != "a1" {
+		t.Errorf("expect 'a1' after release, got - '%s'", entry.Id)
+	}
+}
+
+func TestQueueFindAndRemove(t *testing.T) {
+	q := NewQueue("test", 10)
+	q.Push(QueueEntry{Id: "1", Sender: "a@x.com", SenderDomain: "x.com", RecipientDomain: "a.com"})
+	q.Push(QueueEntry{Id: "2", Sender: "b@y.com", SenderDomain: "y.com", RecipientDomain: "a.com"})
+	q.Push(QueueEntry{Id: "3", Sender: "c@x.com", SenderDomain: "x.com", RecipientDomain: "b.com",
+		ReceivedTime: time.Now().Add(-time.Hour)})
+
+	if found := q.Find(QueueFilter{Domain: "a.com"}); len(found) != 2 {
+		t.Errorf("expect 2 entries for a.com, got - %d", len(found))
+	}
+	if found := q.Find(QueueFilter{Sender: "x.com"}); len(found) != 2 {
+		t.Errorf("expect 2 entries from x.com, got - %d", len(found))
+	}
+	if found := q.Find(QueueFilter{Sender: "b@y.com"}); len(found) != 1 || found[0].Id != "2" {
+		t.Errorf("expect entry 2 from b@y.com, got - %v", found)
+	}
+	if found := q.Find(QueueFilter{MinAge: time.Minute}); len(found) != 1 || found[0].Id != "3" {
+		t.Errorf("expect entry 3 older than a minute, got - %v", found)
+	}
+
+	removed := q.Remove(QueueFilter{Id: "2"})
+	if len(removed) != 1 || removed[0].Id != "2" {
+		t.Errorf("expect entry 2 removed, got - %v", removed)
+	}
+	if _, found := q.Get("2"); found {
+		t.Errorf("entry 2 still indexed after remove")
+	}
+	if l := q.Len(); l != 2 {
+		t.Errorf("expect 2 entries left, got - %d", l)
+	}
+}
+
+func TestQueueTryPush(t *testing.T) {
+	q := NewQueue("test", 1)
+	if !q.TryPush(QueueEntry{Id: "1"}) {
+		t.Errorf("expect entry 1 queued")
+	}
+	if q.TryPush(QueueEntry{Id: "2"}) {
+		t.Errorf("expect entry 2 refused by a full queue")
+	}
+	if l := q.Len(); l != 1 {
+		t.Errorf("expect 1 entry, got - %d", l)
+	}
+}
+
+func TestQueueIdSortsByTime(t *testing.T) {
+	first := NewQueueId()
+	time.Sleep(time.Millisecond)
+	second := NewQueueId()
+	if len(first) != len(second) || first >= second {
+		t.Errorf("expect '%s' to sort before '%s'", first, second)
+	}
+	if id := SubQueueId(first, 2); id != first+".2" {
+		t.Errorf("expect '%s.2', got - '%s'", first, id)
+	}
+}
+
+func TestQueuePushKeepsIdsUnique(t *testing.T) {
+	q := NewQueue("test", 10)
+	q.Push(QueueEntry{Id: "1", RecipientDomain: "a.com"})
+	q.Push(QueueEntry{Id: "1", RecipientDomain: "b.com"})
+	if l := q.Len(); l != 2 {
+		t.Errorf("expect 2 entries, got - %d", l)
+	}
+	if entry, found := q.Get("1"); !found || entry.RecipientDomain != "a.com" {
+		t.Errorf("expect entry 1 kept for a.com, got - %v", entry)
+	}
+	if found := q.Find(QueueFilter{Domain: "b.com"}); len(found) != 1 || found[0].Id == "1" {
+		t.Errorf("expect entry for b.com under a new ID, got - %v", found)
+	}
+}
+
+func TestQueueFindByQueueId(t *testing.T) {
+	q := NewQueue("test", 10)
+	q.Push(QueueEntry{Id: "A.1", QueueId: "A", RecipientDomain: "a.com"})
+	q.Push(QueueEntry{Id: "A.2", QueueId: "A", RecipientDomain: "b.com"})
+	q.Push(QueueEntry{Id: "B.1", QueueId: "B", RecipientDomain: "a.com"})
+
+	if found := q.Find(QueueFilter{Id: "A"}); len(found) != 2 {
+		t.Errorf("expect 2 entries for queue ID A, got - %v", found)
+	}
+	if found := q.Find(QueueFilter{Id: "A.2"}); len(found) != 1 || found[0].RecipientDomain != "b.com" {
+		t.Errorf("expect entry A.2 for b.com, got - %v", found)
+	}
+}
+
+func TestQueuePopByPriority(t *testing.T) {
+	q := NewQueue("test", 100)
+	for i := 0; i < 20; i++ {
+		q.Push(QueueEntry{Id: "bulk" + strconv.Itoa(i), Priority: PRIORITY_BULK})
+	}
+	q.Push(QueueEntry{Id: "normal"})
+	q.Push(QueueEntry{Id: "high", Priority: PRIORITY_HIGH})
+
+	if entry := q.Pop(); entry.Id != "high" {
+		t.Errorf("expect 'high', got - '%s'", entry.Id)
+	}
+	if entry := q.Pop(); entry.Id != "normal" {
+		t.Errorf("expect 'normal', got - '%s'", entry.Id)
+	}
+	if entry := q.Pop(); entry.Id != "bulk0" {
+		t.Errorf("expect 'bulk0', got - '%s'", entry.Id)
+	}
+
+	// Bulk gets one turn per round while high priority mail keeps coming
+	q = NewQueue("test", 100)
+	for i := 0; i < 2; i++ {
+		q.Push(QueueEntry{Id: "bulk" + strconv.Itoa(i), Priority: PRIORITY_BULK})
+	}
+	for i := 0; i < 40; i++ {
+		q.Push(QueueEntry{Id: "high" + strconv.Itoa(i), Priority: PRIORITY_HIGH})
+	}
+	for i := 0; i < 16; i++ {
+		if entry := q.Pop(); entry.Priority != PRIORITY_HIGH {
+			t.Errorf("expect high priority entry %d, got - '%s'", i, entry.Id)
+		}
+	}
+	if entry := q.Pop(); entry.Id != "bulk0" {
+		t.Errorf("expect 'bulk0' after a round of high priority, got - '%s'", entry.Id)
+	}
+	if entry := q.Pop(); entry.Id != "high16" {
+		t.Errorf("expect 'high16', got - '%s'", entry.Id)
+	}
+	if found := q.Find(QueueFilter{}); len(found) != 24 || found[0].Id != "high17" || found[23].Id != "bulk1" {
+		t.Errorf("expect 24 entries, high priority first, got - %v", found)
+	}
+}
+
+func TestOrderedQueue(t *testing.T) {
+	q := NewQueue("test", 10)
+	q.Ordered = true
+	now := time.Now()
+	q.Push(QueueEntry{Id: "later", UnqueueTime: now.Add(time.Hour)})
+	q.Push(QueueEntry{Id: "sooner", UnqueueTime: now.Add(time.Minute)})
+	q.Push(QueueEntry{Id: "due", UnqueueTime: now.Add(-time.Minute)})
+
+	if found := q.Find(QueueFilter{}); len(found) != 3 || found[0].Id != "due" || found[2].Id != "later" {
+		t.Errorf("expect entries sorted by time, got - %v", found)
+	}
+	if entry := q.Pop(); entry.Id != "due" {
+		t.Errorf("expect 'due', got - '%s'", entry.Id)
+	}
+}
+
+func TestScheduleMail(t *testing.T) {
+	oldConf, oldMail, oldError, oldScheduled := conf, MailQueue, ErrorQueue, ScheduledQueue
+	defer func() { conf, MailQueue, ErrorQueue, ScheduledQueue = oldConf, oldMail, oldError, oldScheduled }()
+	conf = &Conf{}
+	MailQueue = NewQueue(MAIL_QUEUE_NAME, 10)
+	ErrorQueue = NewQueue(ERROR_QUEUE_NAME, 10)
+	ScheduledQueue = NewQueue(SCHEDULED_QUEUE_NAME, 10)
+	ScheduledQueue.Ordered = true
+
+	sendAfter := time.Now().Add(time.Hour)
+	PushMail(QueueEntry{Id: "A.1", QueueId: "A", SendAfter: sendAfter, UnqueueTime: sendAfter})
+	PushMail(QueueEntry{Id: "B.1", QueueId: "B"})
+	if MailQueue.Len() != 1 || ScheduledQueue.Len() != 1 {
+		t.Errorf("expect one entry in each queue, got - %d mail, %d scheduled", MailQueue.Len(), ScheduledQueue.Len())
+	}
+
+	if n := ScheduleMail(QueueFilter{Id: "B"}, sendAfter); n != 1 {
+		t.Errorf("expect 1 entry scheduled, got - %d", n)
+	}
+	if n := ScheduleMail(QueueFilter{Id: "A"}, time.Time{}); n != 1 {
+		t.Errorf("expect 1 entry sent now, got - %d", n)
+	}
+	if entry, found := MailQueue.Get("A.1"); !found || !entry.SendAfter.IsZero() {
+		t.Errorf("expect A.1 in the mail queue, got - %v", entry)
+	}
+	if _, found := ScheduledQueue.Get("B.1"); !found {
+		t.Errorf("expect B.1 in the scheduled queue")
+	}
+}
@@ -28,6 +28,9 @@ type EmailMessageWithByteArray struct {
 	Recipients []string `protobuf:"bytes,2,rep,name=Recipients" json:"Recipients,omitempty"`
 	EmlData    []byte   `protobuf:"bytes,3,opt,name=EmlData" json:"EmlData,omitempty"`
 	MessageId  *string  `protobuf:"bytes,4,opt,name=MessageId" json:"MessageId,omitempty"`
+	Priority   *int32   `protobuf:"varint,5,opt,name=Priority" json:"Priority,omitempty"`
+	SendAfter  *int64   `protobuf:"varint,6,opt,name=SendAfter" json:"SendAfter,omitempty"`
+	CampaignId *string  `protobuf:"bytes,7,opt,name=CampaignId" json:"CampaignId,omitempty"`
 	//XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -63,6 +66,27 @@ func (m *EmailMessageWithByteArray) GetMessageId() string {
 	return ""
 }
 
+func (m *EmailMessageWithByteArray) GetPriority() int32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
+func (m *EmailMessageWithByteArray) GetSendAfter() int64 {
+	if m != nil && m.SendAfter != nil {
+		return *m.SendAfter
+	}
+	return 0
+}
+
+func (m *EmailMessageWithByteArray) GetCampaignId() string {
+	if m != nil && m.CampaignId != nil {
+		return *m.CampaignId
+	}
+	return ""
+}
+
 type EmailMessageWithByteArrayPacket struct {
 	Messages []*EmailMessageWithByteArray `protobuf:"bytes,1,rep,name=Messages" json:"Messages,omitempty"`
 	//XXX_unrecognized []byte                       `json:"-"`
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"smtprelay/spool"
+	"strings"
+)
+
+// Queue entry priorities. Normal is the zero value, so entries made without
+// a priority are normal.
+const (
+	PRIORITY_BULK   = -1
+	PRIORITY_NORMAL = 0
+	PRIORITY_HIGH   = 1
+)
+
+// PRIORITY_HEADER is read for the priority of a message and removed on
+// intake. Precedence is read as well but kept, as autoresponders rely on it.
+const PRIORITY_HEADER = "X-Priority"
+
+var priorityNames = map[string]int{
+	"bulk":   PRIORITY_BULK,
+	"normal": PRIORITY_NORMAL,
+	"high":   PRIORITY_HIGH,
+}
+
+// priorityWeights is how many entries of each priority, bulk first, Pop
+// takes in a round while all of them have mail waiting
+var priorityWeights = []int{1, 4, 16}
+
+// priorityLevel returns the index of priority in priorityWeights, clamping
+// unknown values to the nearest priority
+func priorityLevel(priority int) int {
+	if priority < PRIORITY_BULK {
+		priority = PRIORITY_BULK
+	} else if priority > PRIORITY_HIGH {
+		priority = PRIORITY_HIGH
+	}
+	return priority - PRIORITY_BULK
+}
+
+// ParsePriority parses a priority name from the config, empty for normal
+func ParsePriority(name string) (int, error) {
+	if name == "" {
+		return PRIORITY_NORMAL, nil
+	}
+	priority, found := priorityNames[strings.ToLower(name)]
+	if !found {
+		return PRIORITY_NORMAL, errors.New("unknown priority " + name)
+	}
+	return priority, nil
+}
+
+// HeaderPriority returns the priority the message header asks for with
+// X-Priority (1-2 high, 4-5 bulk) or Precedence (bulk, list, junk)
+func HeaderPriority(header mail.Header) (priority int, found bool) {
+	if value := strings.TrimSpace(header.Get(PRIORITY_HEADER)); value != "" {
+		switch value[0] {
+		case '1', '2':
+			return PRIORITY_HIGH, true
+		case '4', '5':
+			return PRIORITY_BULK, true
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return PRIORITY_BULK, true
+	}
+	return PRIORITY_NORMAL, false
+}
+
+// MessagePriority is the priority of msg: the listener's, or the header's
+// if that is lower. Clients can mark mail as bulk, but only a high priority
+// listener takes high priority mail.
+func MessagePriority(msg *Msg, listenerPriority string) int {
+	priority, _ := ParsePriority(listenerPriority)
+	if header, found := HeaderPriority(msg.Message.Header); found && header < priority {
+		return header
+	}
+	return priority
+}
+
+// TakePriority returns MessagePriority of msg and removes PRIORITY_HEADER
+// from body, so the next hop doesn't act on a priority the relay didn't
+// grant
+func TakePriority(msg *Msg, body *spool.Body, listenerPriority string) (int, error) {
+	priority := MessagePriority(msg, listenerPriority)
+	if msg.Message.Header.Get(PRIORITY_HEADER) == "" {
+		return priority, nil
+	}
+	return priority, RemoveHeader(body, PRIORITY_HEADER)
+}
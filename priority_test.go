@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/mail"
+	"smtprelay/spool"
+	"strings"
+	"testing"
+)
+
+func TestHeaderPriority(t *testing.T) {
+	for _, c := range []struct {
+		header mail.Header
+		expect int
+		found  bool
+	}{
+		{mail.Header{"X-Priority": {"1 (Highest)"}}, PRIORITY_HIGH, true},
+		{mail.Header{"X-Priority": {"3 (Normal)"}}, PRIORITY_NORMAL, false},
+		{mail.Header{"X-Priority": {"5"}}, PRIORITY_BULK, true},
+		{mail.Header{"Precedence": {"Bulk"}}, PRIORITY_BULK, true},
+		{mail.Header{"Precedence": {"first-class"}}, PRIORITY_NORMAL, false},
+		{mail.Header{}, PRIORITY_NORMAL, false},
+	} {
+		if priority, found := HeaderPriority(c.header); priority != c.expect || found != c.found {
+			t.Errorf("%v: expect %d/%t, got - %d/%t", c.header, c.expect, c.found, priority, found)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Errorf("expect error for unknown priority")
+	}
+	if priority, err := ParsePriority("HIGH"); err != nil || priority != PRIORITY_HIGH {
+		t.Errorf("expect %d, got - %d", PRIORITY_HIGH, priority)
+	}
+}
+
+func TestTakePriority(t *testing.T) {
+	conf = &Conf{ServerHostName: "relay.example.net"}
+	for _, c := range []struct {
+		header   string
+		listener string
+		expect   int
+	}{
+		{"X-Priority: 1\r\n", "", PRIORITY_NORMAL},
+		{"X-Priority: 1\r\n", "high", PRIORITY_HIGH},
+		{"X-Priority: 5\r\n", "high", PRIORITY_BULK},
+		{"Precedence: bulk\r\n", "", PRIORITY_BULK},
+		{"", "bulk", PRIORITY_BULK},
+	} {
+		body := spool.NewBody([]byte(c.header + "Subject: test\r\n\r\nbody\r\n"))
+		msg, err := ParseMessageBody([]string{"<a@example.com>"}, "<sender@example.com>", body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		priority, err := TakePriority(&msg, body, c.listener)
+		if err != nil || priority != c.expect {
+			t.Errorf("%q on %q listener: expect %d, got - %d (%v)", c.header, c.listener, c.expect, priority, err)
+		}
+		data, _ := body.Bytes()
+		if strings.Contains(string(data), PRIORITY_HEADER) {
+			t.Errorf("expect %s removed, got - '%s'", PRIORITY_HEADER, data)
+		}
+	}
+}
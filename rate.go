@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const RATE_WINDOW_SECONDS = 3600
+
+// Rates holds event counts over the last second, minute and hour
+type Rates struct {
+	PerSecond int64
+	PerMinute int64
+	PerHour   int64
+}
+
+// RateCounter counts events in a ring of one-second buckets covering the
+// last hour plus the current second. Only complete seconds are reported, so
+// PerSecond is the count of the previous second.
+type RateCounter struct {
+	sync.Mutex
+	counts []int64
+	stamps []int64
+	now    func() time.Time
+}
+
+func NewRateCounter() *RateCounter {
+	return &RateCounter{
+		counts: make([]int64, RATE_WINDOW_SECONDS+1),
+		stamps: make([]int64, RATE_WINDOW_SECONDS+1),
+		now:    time.Now,
+	}
+}
+
+func (r *RateCounter) Add(n int64) {
+	second := r.now().Unix()
+	i := second % int64(len(r.counts))
+	r.Lock()
+	if r.stamps[i] != second {
+		r.stamps[i] = second
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+	r.Unlock()
+}
+
+// sum returns the number of events in the given number of complete seconds
+// before now. Must be called with the lock held.
+func (r *RateCounter) sum(now int64, seconds int64) (total int64) {
+	for second := now - seconds; second < now; second++ {
+		i := second % int64(len(r.counts))
+		if r.stamps[i] == second {
+			total += r.counts[i]
+		}
+	}
+	return
+}
+
+func (r *RateCounter) Rates() (rates Rates) {
+	now := r.now().Unix()
+	r.Lock()
+	defer r.Unlock()
+	rates.PerSecond = r.sum(now, 1)
+	rates.PerMinute = r.sum(now, 60)
+	rates.PerHour = r.sum(now, RATE_WINDOW_SECONDS)
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateCounterWindows(t *testing.T) {
+	clock := time.Unix(1000000, 0)
+	r := NewRateCounter()
+	r.now = func() time.Time { return clock }
+
+	r.Add(5) // 1000000
+	clock = clock.Add(30 * time.Second)
+	r.Add(3) // 1000030
+	clock = clock.Add(40 * time.Minute)
+	r.Add(2) // 1002430
+	clock = clock.Add(time.Second)
+	r.Add(7) // 1002431, current second isn't reported
+
+	expect := Rates{PerSecond: 2, PerMinute: 2, PerHour: 10}
+	if rates := r.Rates(); rates != expect {
+		t.Errorf("expect '%+v', got - '%+v'", expect, rates)
+	}
+
+	clock = clock.Add(time.Hour + time.Second)
+	expect = Rates{}
+	if rates := r.Rates(); rates != expect {
+		t.Errorf("expect '%+v' after an idle hour, got - '%+v'", expect, rates)
+	}
+
+	r.Add(1)
+	clock = clock.Add(RATE_WINDOW_SECONDS * time.Second)
+	expect = Rates{PerHour: 1}
+	if rates := r.Rates(); rates != expect {
+		t.Errorf("expect '%+v' at the window edge, got - '%+v'", expect, rates)
+	}
+}
+
+// Run with -race
+func TestRateCounterConcurrent(t *testing.T) {
+	r := NewRateCounter()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.Add(1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Rates()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"smtprelay/smtpd"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_CLIENT        = "client"
+	RATE_LIMIT_AUTH_USER     = "auth_user"
+	RATE_LIMIT_SENDER_DOMAIN = "sender_domain"
+)
+
+// RateLimitConf limits the messages and recipients accepted per minute for
+// one key. Zero means no limit.
+type RateLimitConf struct {
+	MessagesPerMinute   int
+	RecipientsPerMinute int
+}
+
+// tokenBucket holds up to size tokens and gains size tokens per minute. A
+// size of zero is no limit.
+type tokenBucket struct {
+	tokens float64
+	stamp  time.Time
+}
+
+func (b *tokenBucket) refill(size int, now time.Time) {
+	b.tokens += now.Sub(b.stamp).Minutes() * float64(size)
+	if b.tokens > float64(size) {
+		b.tokens = float64(size)
+	}
+	b.stamp = now
+}
+
+func (b *tokenBucket) take(size int, cost float64) {
+	if size > 0 {
+		b.tokens -= cost
+	}
+}
+
+// available reports whether cost tokens can be taken. A cost above the
+// bucket size needs a full bucket, so it is slowed down but never refused
+// for good.
+func (b *tokenBucket) available(size int, cost float64) bool {
+	if size <= 0 {
+		return true
+	}
+	if cost > float64(size) {
+		cost = float64(size)
+	}
+	return b.tokens >= cost
+}
+
+type rateLimitBuckets struct {
+	messages   tokenBucket
+	recipients tokenBucket
+}
+
+// RateLimiter keeps a pair of token buckets per key, e.g. per client IP
+type RateLimiter struct {
+	Name string
+	RateLimitConf
+	buckets map[string]*rateLimitBuckets
+}
+
+func (l *RateLimiter) enabled() bool {
+	return l.MessagesPerMinute > 0 || l.RecipientsPerMinute > 0
+}
+
+func (l *RateLimiter) bucket(key string, now time.Time) *rateLimitBuckets {
+	b, found := l.buckets[key]
+	if !found {
+		b = &rateLimitBuckets{
+			messages:   tokenBucket{tokens: float64(l.MessagesPerMinute), stamp: now},
+			recipients: tokenBucket{tokens: float64(l.RecipientsPerMinute), stamp: now},
+		}
+		l.buckets[key] = b
+	}
+	b.messages.refill(l.MessagesPerMinute, now)
+	b.recipients.refill(l.RecipientsPerMinute, now)
+	return b
+}
+
+// prune drops buckets that have filled up again, they are the same as new ones
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		b.messages.refill(l.MessagesPerMinute, now)
+		b.recipients.refill(l.RecipientsPerMinute, now)
+		if b.messages.tokens >= float64(l.MessagesPerMinute) && b.recipients.tokens >= float64(l.RecipientsPerMinute) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitRequest is one message to account for: its client address, auth
+// user, envelope sender domain and recipient count
+type RateLimitRequest struct {
+	Client       net.IP
+	AuthUser     string
+	SenderDomain string
+	Recipients   int
+}
+
+func (r RateLimitRequest) key(limiter string) string {
+	switch limiter {
+	case RATE_LIMIT_CLIENT:
+		if r.Client == nil {
+			return ""
+		}
+		return r.Client.String()
+	case RATE_LIMIT_AUTH_USER:
+		return r.AuthUser
+	default:
+		return strings.ToLower(r.SenderDomain)
+	}
+}
+
+var (
+	rateLimitMutex sync.Mutex
+	rateLimiters   []*RateLimiter
+	rateLimitPrune time.Time
+	rateLimitNow   = time.Now
+)
+
+func NewRateLimiter(name string, c RateLimitConf) (*RateLimiter, error) {
+	if c.MessagesPerMinute < 0 || c.RecipientsPerMinute < 0 {
+		return nil, errors.New(name + " rate limit must not be negative")
+	}
+	return &RateLimiter{Name: name, RateLimitConf: c, buckets: make(map[string]*rateLimitBuckets)}, nil
+}
+
+// LoadRateLimits builds the intake rate limiters from conf. Limiters whose
+// settings didn't change keep their buckets. On error the old limits stay in
+// force.
+func LoadRateLimits() error {
+	var limiters []*RateLimiter
+	for _, c := range []struct {
+		name  string
+		limit RateLimitConf
+	}{
+		{RATE_LIMIT_CLIENT, conf.ClientRateLimit},
+		{RATE_LIMIT_AUTH_USER, conf.AuthUserRateLimit},
+		{RATE_LIMIT_SENDER_DOMAIN, conf.SenderDomainRateLimit},
+	} {
+		limiter, err := NewRateLimiter(c.name, c.limit)
+		if err != nil {
+			return err
+		}
+		limiters = append(limiters, limiter)
+	}
+	rateLimitMutex.Lock()
+	for i, old := range rateLimiters {
+		if old.RateLimitConf == limiters[i].RateLimitConf {
+			limiters[i] = old
+		}
+	}
+	rateLimiters = limiters
+	rateLimitMutex.Unlock()
+	return nil
+}
+
+// CheckRateLimits accounts for requests, all of them or none: if any limit
+// would be exceeded nothing is taken and a 451 error naming the limit is
+// returned.
+func CheckRateLimits(requests ...RateLimitRequest) error {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+	now := rateLimitNow()
+	if now.Sub(rateLimitPrune) > time.Minute {
+		for _, limiter := range rateLimiters {
+			limiter.prune(now)
+		}
+		rateLimitPrune = now
+	}
+
+	type cost struct {
+		limiter              *RateLimiter
+		messages, recipients float64
+	}
+	costs := make(map[*rateLimitBuckets]*cost)
+	for _, limiter := range rateLimiters {
+		if !limiter.enabled() {
+			continue
+		}
+		for _, r := range requests {
+			key := r.key(limiter.Name)
+			if key == "" {
+				continue
+			}
+			b := limiter.bucket(key, now)
+			c, found := costs[b]
+			if !found {
+				c = &cost{limiter: limiter}
+				costs[b] = c
+			}
+			c.messages++
+			c.recipients += float64(r.Recipients)
+			if !b.messages.available(limiter.MessagesPerMinute, c.messages) ||
+				!b.recipients.available(limiter.RecipientsPerMinute, c.recipients) {
+				RateLimitedCounter.With(limiter.Name).Inc()
+				return smtpd.Error{Code: 451, Message: fmt.Sprintf("4.7.1  Rate limit exceeded for %s %s, try again later", strings.Replace(limiter.Name, "_", " ", -1), key)}
+			}
+		}
+	}
+	for b, c := range costs {
+		b.messages.take(c.limiter.MessagesPerMinute, c.messages)
+		b.recipients.take(c.limiter.RecipientsPerMinute, c.recipients)
+	}
+	return nil
+}
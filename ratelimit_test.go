@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckRateLimits(t *testing.T) {
+	oldConf, oldLimiters, oldNow := conf, rateLimiters, rateLimitNow
+	defer func() { conf, rateLimiters, rateLimitNow = oldConf, oldLimiters, oldNow }()
+	clock := time.Unix(1000000, 0)
+	rateLimitNow = func() time.Time { return clock }
+	rateLimiters = nil
+	conf = &Conf{
+		ClientRateLimit:       RateLimitConf{MessagesPerMinute: 2},
+		SenderDomainRateLimit: RateLimitConf{RecipientsPerMinute: 10},
+	}
+	if err := LoadRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+	client := net.ParseIP("10.0.0.1")
+
+	if err := CheckRateLimits(RateLimitRequest{Client: client, SenderDomain: "a.com", Recipients: 4}); err != nil {
+		t.Errorf("expect first message accepted, got - '%s'", err.Error())
+	}
+	// Two messages don't fit the one left, so neither is taken
+	if err := CheckRateLimits(
+		RateLimitRequest{Client: client, SenderDomain: "a.com", Recipients: 1},
+		RateLimitRequest{Client: client, SenderDomain: "b.com", Recipients: 1}); err == nil {
+		t.Errorf("expect packet over the client limit refused")
+	}
+	if err := CheckRateLimits(RateLimitRequest{Client: client, SenderDomain: "A.com", Recipients: 7}); err == nil {
+		t.Errorf("expect message over the sender domain limit refused")
+	}
+	if err := CheckRateLimits(RateLimitRequest{Client: client, SenderDomain: "a.com", Recipients: 6}); err != nil {
+		t.Errorf("expect message within the limits accepted, got - '%s'", err.Error())
+	}
+	if err := CheckRateLimits(RateLimitRequest{Client: client, SenderDomain: "b.com", Recipients: 1}); err == nil {
+		t.Errorf("expect third message of the minute refused")
+	} else if expect := "451 4.7.1  Rate limit exceeded for client 10.0.0.1, try again later"; err.Error() != expect {
+		t.Errorf("expect '%s', got - '%s'", expect, err.Error())
+	}
+
+	clock = clock.Add(30 * time.Second)
+	if err := CheckRateLimits(RateLimitRequest{Client: client, SenderDomain: "b.com", Recipients: 1}); err != nil {
+		t.Errorf("expect a token back after half a minute, got - '%s'", err.Error())
+	}
+
+	// Reloading unchanged limits keeps the buckets
+	if err := LoadRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckRateLimits(RateLimitRequest{Client: client, SenderDomain: "b.com", Recipients: 1}); err == nil {
+		t.Errorf("expect client limit kept over reload")
+	}
+
+	conf.ClientRateLimit.MessagesPerMinute = -1
+	if err := LoadRateLimits(); err == nil {
+		t.Errorf("expect error for a negative limit")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/mail"
+	"smtprelay/spool"
+	"time"
+)
+
+// DELIVER_AFTER_HEADER holds the time a message is to be sent after, in
+// the RFC 5322 date format, e.g. "Tue, 20 Oct 2026 09:00:00 +0200". It is
+// removed from the message on intake.
+const DELIVER_AFTER_HEADER = "X-Deliver-After"
+
+// TakeSendAfter returns the time msg asks to be sent after, zero if it
+// doesn't, and removes the header from body. An unreadable date is logged
+// and ignored, so the message goes out right away.
+func TakeSendAfter(msg *Msg, body *spool.Body) (sendAfter time.Time, err error) {
+	value := msg.Message.Header.Get(DELIVER_AFTER_HEADER)
+	if value == "" {
+		return
+	}
+	if err := RemoveHeader(body, DELIVER_AFTER_HEADER); err != nil {
+		return sendAfter, err
+	}
+	sendAfter, err = mail.ParseDate(value)
+	if err != nil {
+		log.Warn("message %s has invalid %s %q, sending it now: %s", msg.String(), DELIVER_AFTER_HEADER, value, err.Error())
+		return time.Time{}, nil
+	}
+	return sendAfter, nil
+}
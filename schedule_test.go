@@ -0,0 +1,33 @@
+package main
+
+import (
+	"smtprelay/spool"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTakeSendAfter(t *testing.T) {
+	data := "X-Deliver-After: Tue, 20 Oct 2026 09:00:00 +0200\r\nSubject: test\r\n\r\nbody\r\n"
+	body := spool.NewBody([]byte(data))
+	msg, err := ParseMessageBody([]string{"rcpt@example.org"}, "sender@example.com", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendAfter, err := TakeSendAfter(&msg, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := time.Date(2026, 10, 20, 7, 0, 0, 0, time.UTC); !sendAfter.Equal(expect) {
+		t.Errorf("expect '%s', got - '%s'", expect, sendAfter)
+	}
+	if b, _ := body.Bytes(); string(b) != "Subject: test\r\n\r\nbody\r\n" {
+		t.Errorf("expect header removed, got - '%s'", b)
+	}
+
+	body = spool.NewBody([]byte(strings.Replace(data, "Tue, 20 Oct 2026 09:00:00 +0200", "tomorrow", 1)))
+	msg, _ = ParseMessageBody([]string{"rcpt@example.org"}, "sender@example.com", body)
+	if sendAfter, err := TakeSendAfter(&msg, body); err != nil || !sendAfter.IsZero() {
+		t.Errorf("expect invalid date ignored, got - '%s', %v", sendAfter, err)
+	}
+}
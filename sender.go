@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io"
 	"smtprelay/smtp"
+	"strings"
 	"time"
 )
 
@@ -11,8 +13,13 @@ var (
 
 func StartSender() {
 	SenderLimiter = make(chan interface{}, conf.MaxOutcomingConnections)
+	MailQueue.Paused = Holds.AllHeld
+	MailQueue.IsHeld = func(entry *QueueEntry) bool {
+		return Holds.IsHeld(entry.RecipientDomain)
+	}
 	go CloneMailers()
 	go StartErrorHandler()
+	go StartScheduledHandler()
 }
 
 func StartErrorHandler() {
@@ -22,6 +29,14 @@ func StartErrorHandler() {
 	}
 }
 
+func StartScheduledHandler() {
+	for {
+		entry := ExtractScheduled()
+		log.Info("msg %s RELEASED from scheduled queue", entry.String())
+		PushMail(entry)
+	}
+}
+
 func CloneMailers() {
 	for {
 		entry := PopMail()
@@ -37,38 +52,72 @@ func SendMail(entry QueueEntry) {
 		<-SenderLimiter
 	}()
 	var err error
-	var data []byte
+	body, err := entry.Body.Open()
+	if err != nil {
+		log.Error("msg %s DROPPED: can't read message body: %s", entry.String(), err.Error())
+		observeDelivery(entry, DELIVERY_RESULT_DROPPED, StatusServerError, time.Now())
+		MailDroppedIncreaseCounter(1)
+		entry.Body.Release()
+		return
+	}
+	defer body.Close()
+	var data io.Reader = body
 	var signed = ""
 	if conf.DKIMEnabled {
-		data, err = DKIMSign(entry.Data, entry.SenderDomain)
+		signature := entry.Signature
+		if signature == nil {
+			signature = &DKIMSignature{}
+		}
+		header, err := signature.Header(entry.Body, entry.SenderDomain)
 		if err != nil {
-			data = entry.Data
 			signed = "(NOT SIGNED)"
+			DKIMSignFailuresCounter.With(entry.SenderDomain).Inc()
+		} else {
+			data = io.MultiReader(strings.NewReader(header), body)
 		}
-	} else {
-		data = entry.Data
 	}
 
-	if err := smtp.SendMail(
+	if entry.ErrorCount > 0 {
+		DeliveryRetriesCounter.With(entry.RecipientDomain).Inc()
+	}
+	started := time.Now()
+	opts := &smtp.MailOptions{
+		BinaryMIME: entry.BodyType == "BINARYMIME",
+		SMTPUTF8:   entry.SMTPUTF8,
+	}
+	opts.Ret, opts.EnvID, opts.Recipients = DSNOptions(entry)
+	if err := smtp.SendMailReader(
 		entry.MailServer,
 		nil,
 		entry.Sender,
 		entry.Recipients,
 		data,
-		conf.ServerHostName); err != nil {
+		conf.ServerHostName,
+		opts); err != nil {
 		smtpError := ParseOutcomingError(err.Error())
 		if smtpError.Code/100 == 5 {
 			log.Error("msg %s DROPPED: %s", entry.String(), smtpError.Error())
+			observeDelivery(entry, DELIVERY_RESULT_DROPPED, smtpError.Code, started)
 			MailDroppedIncreaseCounter(1)
+			notifySender(entry, DSN_ACTION_FAILED, smtpError)
+			entry.Body.Release()
 			return
 		} else {
 			entry.ErrorCount += 1
 			entry.Error = smtpError
 			if entry.ErrorCount >= conf.DeferredMailMaxErrors {
 				log.Error("msg %s DEFER LIMIT=(%d/%d) DROPPED: %s", entry.String(), entry.ErrorCount, conf.DeferredMailMaxErrors, smtpError.Error())
+				observeDelivery(entry, DELIVERY_RESULT_DROPPED, smtpError.Code, started)
 				MailDroppedIncreaseCounter(1)
+				notifySender(entry, DSN_ACTION_FAILED, smtpError)
+				entry.Body.Release()
 				return
 			}
+			if entry.ErrorCount == 1 {
+				notifySender(entry, DSN_ACTION_DELAYED, smtpError)
+			}
+			observeDelivery(entry, DELIVERY_RESULT_DEFERRED, smtpError.Code, started)
+			MailDeferredIncreaseCounter(1)
 			entry.QueueTime = time.Now()
 			entry.UnqueueTime = entry.QueueTime.Add(time.Duration(conf.DeferredMailDelay) * time.Second)
 			oldMX := entry.MailServer
@@ -86,7 +135,18 @@ func SendMail(entry QueueEntry) {
 		}
 	} else {
 		log.Info("msg %s SENT%s: %s", entry.String(), signed, ErrStatusSuccess.Error())
+		observeDelivery(entry, DELIVERY_RESULT_SENT, StatusSuccess, started)
 		MailSentIncreaseCounter(1)
+		if opts.DSNDropped {
+			notifySender(entry, DSN_ACTION_RELAYED, ErrStatusSuccess)
+		}
+		entry.Body.Release()
 	}
 
 }
+
+func observeDelivery(entry QueueEntry, result string, code int, started time.Time) {
+	DeliveriesCounter.With(result, StatusClass(code), entry.RecipientDomain).Inc()
+	DeliveryDuration.With(result).Observe(time.Since(started).Seconds())
+	Campaigns.Record(entry.CampaignId, entry.Id, result)
+}
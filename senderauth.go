@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"smtprelay/smtpd"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrSenderDomainNotAllowed = smtpd.Error{Code: 550, Message: "5.7.1  Sender domain not allowed for this client"}
+	ErrSenderDomainNoKey      = smtpd.Error{Code: 550, Message: "5.7.1  Sender domain has no DKIM key on this relay"}
+	ErrHeaderFromMismatch     = smtpd.Error{Code: 550, Message: "5.7.1  Header From domain not allowed for this client"}
+)
+
+// SenderPolicy lists the sender domains each AUTH user and each client
+// network may use. Clients without an entry may send as any domain.
+type SenderPolicy struct {
+	users    map[string]map[string]bool
+	networks []networkSenderDomains
+}
+
+type networkSenderDomains struct {
+	network *net.IPNet
+	domains map[string]bool
+}
+
+var (
+	senderPolicyMutex sync.RWMutex
+	senderPolicy      = &SenderPolicy{}
+)
+
+func domainSet(domains []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, domain := range domains {
+		set[strings.ToLower(strings.TrimSpace(domain))] = true
+	}
+	return set
+}
+
+func NewSenderPolicy(users map[string][]string, networks map[string][]string) (*SenderPolicy, error) {
+	policy := &SenderPolicy{users: make(map[string]map[string]bool)}
+	for user, domains := range users {
+		policy.users[user] = domainSet(domains)
+	}
+	for network, domains := range networks {
+		nets, err := ParseNetworks([]string{network})
+		if err != nil {
+			return nil, err
+		}
+		policy.networks = append(policy.networks, networkSenderDomains{network: nets[0], domains: domainSet(domains)})
+	}
+	return policy, nil
+}
+
+// Allowed reports whether a client may use domain as sender. An AUTH user
+// with an entry is held to it; otherwise every network entry containing the
+// client address is consulted.
+func (p *SenderPolicy) Allowed(username string, ip net.IP, domain string) bool {
+	domain = strings.ToLower(domain)
+	if domains, found := p.users[username]; found && username != "" {
+		return domains[domain]
+	}
+	matched := false
+	for _, n := range p.networks {
+		if ip == nil || !n.network.Contains(ip) {
+			continue
+		}
+		if n.domains[domain] {
+			return true
+		}
+		matched = true
+	}
+	return !matched
+}
+
+// Applies reports whether the client has a user or network entry, i.e.
+// whether Allowed can refuse any domain for it
+func (p *SenderPolicy) Applies(username string, ip net.IP) bool {
+	if _, found := p.users[username]; found && username != "" {
+		return true
+	}
+	for _, n := range p.networks {
+		if ip != nil && n.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSenderPolicy builds the sender domain policy from conf. On error the
+// old policy stays in force.
+func LoadSenderPolicy() error {
+	if conf.StrictSenderDomains && !conf.DKIMEnabled {
+		return errors.New("StrictSenderDomains requires DKIMEnabled")
+	}
+	policy, err := NewSenderPolicy(conf.UserSenderDomains, conf.NetworkSenderDomains)
+	if err != nil {
+		return fmt.Errorf("sender domain policy: %s", err.Error())
+	}
+	senderPolicyMutex.Lock()
+	senderPolicy = policy
+	senderPolicyMutex.Unlock()
+	return nil
+}
+
+func GetSenderPolicy() *SenderPolicy {
+	senderPolicyMutex.RLock()
+	defer senderPolicyMutex.RUnlock()
+	return senderPolicy
+}
+
+func AddressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(addr[at+1:], "> "))
+}
+
+func hasDKIMKey(domain string) bool {
+	for keyDomain := range DKIMRepo {
+		if strings.EqualFold(keyDomain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSenderDomain applies the sender domain policy and, in strict mode,
+// requires a DKIM key for domain
+func CheckSenderDomain(username string, addr net.Addr, domain string) error {
+	if !GetSenderPolicy().Allowed(username, AddrIP(addr), domain) {
+		return ErrSenderDomainNotAllowed
+	}
+	if conf.StrictSenderDomains && !hasDKIMKey(domain) {
+		return ErrSenderDomainNoKey
+	}
+	return nil
+}
+
+// CheckMessageSender checks the envelope sender and every header From
+// address of msg. The null sender of bounces is only checked by header From.
+// Header From is only read when a policy entry or strict mode applies to the
+// client, so without them an unparseable From passes as it always did.
+func CheckMessageSender(username string, addr net.Addr, msg *Msg) error {
+	if msg.Sender.Domain != "" {
+		if err := CheckSenderDomain(username, addr, msg.Sender.Domain); err != nil {
+			return err
+		}
+	}
+	if !conf.StrictSenderDomains && !GetSenderPolicy().Applies(username, AddrIP(addr)) {
+		return nil
+	}
+	from, err := msg.Message.Header.AddressList("From")
+	if err != nil {
+		if err == mail.ErrHeaderNotPresent {
+			return nil
+		}
+		return ErrHeaderFromMismatch
+	}
+	for _, a := range from {
+		if CheckSenderDomain(username, addr, AddressDomain(a.Address)) != nil {
+			return ErrHeaderFromMismatch
+		}
+	}
+	return nil
+}
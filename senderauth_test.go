@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSenderPolicyAllowed(t *testing.T) {
+	policy, err := NewSenderPolicy(
+		map[string][]string{"alice": {"Example.com"}},
+		map[string][]string{"10.0.0.0/8": {"corp.example"}, "10.1.0.0/16": {"branch.example"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	for _, c := range []struct {
+		user, ip, domain string
+		expect           bool
+	}{
+		{"alice", "192.168.1.1", "example.com", true},
+		{"alice", "10.1.2.3", "corp.example", false},
+		{"", "10.2.3.4", "corp.example", true},
+		{"", "10.2.3.4", "branch.example", false},
+		{"", "10.1.2.3", "branch.example", true},
+		{"", "10.1.2.3", "corp.example", true},
+		{"bob", "192.168.1.1", "anything.example", true},
+	} {
+		if got := policy.Allowed(c.user, net.ParseIP(c.ip), c.domain); got != c.expect {
+			t.Errorf("%s@%s as %s: expect %t, got - %t", c.user, c.ip, c.domain, c.expect, got)
+		}
+	}
+}
+
+func TestCheckMessageSenderStrict(t *testing.T) {
+	oldConf, oldRepo, oldPolicy := conf, DKIMRepo, senderPolicy
+	defer func() { conf, DKIMRepo, senderPolicy = oldConf, oldRepo, oldPolicy }()
+	conf = &Conf{DKIMEnabled: true, StrictSenderDomains: true}
+	DKIMRepo = map[string]DKIM{"example.com": {Domain: "example.com"}}
+	senderPolicy = &SenderPolicy{}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	msg, err := ParseMessage([]string{"rcpt@example.org"}, "sender@example.com", strings.NewReader("From: <sender@example.com>\r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMessageSender("", addr, &msg); err != nil {
+		t.Errorf("expect message accepted, got - '%s'", err.Error())
+	}
+
+	msg, err = ParseMessage([]string{"rcpt@example.org"}, "sender@example.com", strings.NewReader("From: <sender@other.example>\r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMessageSender("", addr, &msg); !reflect.DeepEqual(err, ErrHeaderFromMismatch) {
+		t.Errorf("expect '%s', got - '%v'", ErrHeaderFromMismatch.Error(), err)
+	}
+
+	if err := CheckSenderDomain("", addr, "unsigned.example"); !reflect.DeepEqual(err, ErrSenderDomainNoKey) {
+		t.Errorf("expect '%s', got - '%v'", ErrSenderDomainNoKey.Error(), err)
+	}
+}
+
+func TestCheckMessageSenderWithoutPolicy(t *testing.T) {
+	oldConf, oldPolicy := conf, senderPolicy
+	defer func() { conf, senderPolicy = oldConf, oldPolicy }()
+	conf = &Conf{}
+	senderPolicy = &SenderPolicy{}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	msg, err := ParseMessage([]string{"rcpt@example.org"}, "j@example.com", strings.NewReader("From: John Doe, Sales <j@example.com>\r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMessageSender("", addr, &msg); err != nil {
+		t.Errorf("expect unparseable From accepted without a policy, got - '%s'", err.Error())
+	}
+
+	senderPolicy, err = NewSenderPolicy(nil, map[string][]string{"127.0.0.0/8": {"example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMessageSender("", addr, &msg); !reflect.DeepEqual(err, ErrHeaderFromMismatch) {
+		t.Errorf("expect '%s' under a network policy, got - '%v'", ErrHeaderFromMismatch.Error(), err)
+	}
+}
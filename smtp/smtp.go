@@ -7,13 +7,18 @@
 //	8BITMIME  RFC 1652
 //	AUTH      RFC 2554
 //	STARTTLS  RFC 3207
+//	CHUNKING  RFC 3030
+//	SMTPUTF8  RFC 6531
+//	DSN       RFC 3461
 // Additional extensions may be handled by clients.
 package smtp
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/textproto"
@@ -215,29 +220,108 @@ func (c *Client) Auth(a Auth) error {
 	return err
 }
 
+// MailOptions describes the message sent in a mail transaction.
+type MailOptions struct {
+	// BinaryMIME marks a message that may contain binary data. It can only
+	// be sent with BDAT to a server supporting BINARYMIME and CHUNKING.
+	BinaryMIME bool
+	// SMTPUTF8 marks a message with UTF-8 addresses or headers. It can only
+	// be sent to a server supporting SMTPUTF8.
+	SMTPUTF8 bool
+	// Ret and EnvID are the DSN parameters of the message, Recipients those
+	// of each recipient. They are only sent to a server supporting DSN.
+	Ret        string
+	EnvID      string
+	Recipients map[string]RcptOptions
+	// DSNDropped is set by SendMailReader when the server doesn't support
+	// DSN, so the sender has to send success notifications itself.
+	DSNDropped bool
+}
+
+// RcptOptions holds the DSN parameters of a recipient.
+type RcptOptions struct {
+	Notify []string
+	ORcpt  string
+}
+
+// ErrBinaryMIMEUnsupported is returned for a binary message when the server
+// can't take one.
+var ErrBinaryMIMEUnsupported = &textproto.Error{Code: 554, Msg: "5.6.3 Server doesn't support BINARYMIME"}
+
+// ErrSMTPUTF8Unsupported is returned for an internationalized message when
+// the server can't take one.
+var ErrSMTPUTF8Unsupported = &textproto.Error{Code: 553, Msg: "5.6.7 Server doesn't support SMTPUTF8"}
+
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
 // parameter.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 func (c *Client) Mail(from string) error {
+	return c.MailWithOptions(from, nil)
+}
+
+// MailWithOptions is like Mail, but announces a binary message with
+// BODY=BINARYMIME and an internationalized one with SMTPUTF8 if opts asks
+// for it.
+func (c *Client) MailWithOptions(from string, opts *MailOptions) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	cmdStr := "MAIL FROM:<%s>"
-	if c.ext != nil {
-		if _, ok := c.ext["8BITMIME"]; ok {
-			cmdStr += " BODY=8BITMIME"
+	cmdStr := fmt.Sprintf("MAIL FROM:<%s>", from)
+	if opts != nil && opts.BinaryMIME {
+		if !c.hasExt("BINARYMIME") || !c.hasExt("CHUNKING") {
+			return ErrBinaryMIMEUnsupported
+		}
+		cmdStr += " BODY=BINARYMIME"
+	} else if c.hasExt("8BITMIME") {
+		cmdStr += " BODY=8BITMIME"
+	}
+	if opts != nil && opts.SMTPUTF8 {
+		if !c.hasExt("SMTPUTF8") {
+			return ErrSMTPUTF8Unsupported
 		}
+		cmdStr += " SMTPUTF8"
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
+	if opts != nil && c.hasExt("DSN") {
+		if opts.Ret != "" {
+			cmdStr += " RET=" + opts.Ret
+		}
+		if opts.EnvID != "" {
+			cmdStr += " ENVID=" + opts.EnvID
+		}
+	}
+	_, _, err := c.cmd(250, "%s", cmdStr)
 	return err
 }
 
+func (c *Client) hasExt(ext string) bool {
+	if c.ext == nil {
+		return false
+	}
+	_, ok := c.ext[ext]
+	return ok
+}
+
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
 func (c *Client) Rcpt(to string) error {
-	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+	return c.RcptWithOptions(to, nil)
+}
+
+// RcptWithOptions is like Rcpt, but adds the DSN parameters in opts if the
+// server supports DSN.
+func (c *Client) RcptWithOptions(to string, opts *RcptOptions) error {
+	cmdStr := fmt.Sprintf("RCPT TO:<%s>", to)
+	if opts != nil && c.hasExt("DSN") {
+		if len(opts.Notify) > 0 {
+			cmdStr += " NOTIFY=" + strings.Join(opts.Notify, ",")
+		}
+		if opts.ORcpt != "" {
+			cmdStr += " ORCPT=" + opts.ORcpt
+		}
+	}
+	_, _, err := c.cmd(25, "%s", cmdStr)
 	return err
 }
 
@@ -264,6 +348,116 @@ func (c *Client) Data() (io.WriteCloser, error) {
 	return &dataCloser{c, c.Text.DotWriter()}, nil
 }
 
+// bdatChunkSize is the size of the chunks written by Bdat
+const bdatChunkSize = 64 * 1024
+
+type bdatWriter struct {
+	c   *Client
+	buf []byte
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		free := bdatChunkSize - len(w.buf)
+		if len(p) < free {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+		n += free
+		if len(w.buf) == bdatChunkSize {
+			if err := w.send(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *bdatWriter) send(last bool) error {
+	cmdStr := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		cmdStr += " LAST"
+	}
+	if err := w.c.Text.PrintfLine("%s", cmdStr); err != nil {
+		return err
+	}
+	if _, err := w.c.Text.W.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.c.Text.W.Flush(); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	_, _, err := w.c.Text.ReadResponse(250)
+	return err
+}
+
+// Close sends the last chunk and reads the server's reply to the message.
+func (w *bdatWriter) Close() error {
+	return w.send(true)
+}
+
+// Bdat returns a writer that sends the message in BDAT chunks, for servers
+// supporting the CHUNKING extension. Data is sent as is, so line ends must
+// already be CRLF. The caller should close the writer before calling any
+// more methods on c.
+// A call to Bdat must be preceded by one or more calls to Rcpt.
+func (c *Client) Bdat() (io.WriteCloser, error) {
+	if !c.hasExt("CHUNKING") {
+		return nil, errors.New("smtp: server doesn't support CHUNKING")
+	}
+	return &bdatWriter{c: c, buf: make([]byte, 0, bdatChunkSize)}, nil
+}
+
+// CRLFWriter turns bare LF line ends into CRLF, as DotWriter does for DATA
+type CRLFWriter struct {
+	w    io.Writer
+	prev byte
+}
+
+// NewCRLFWriter returns a CRLFWriter writing to w
+func NewCRLFWriter(w io.Writer) *CRLFWriter {
+	return &CRLFWriter{w: w}
+}
+
+func (w *CRLFWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, b := range p {
+		if b == '\n' && w.prev != '\r' {
+			if _, err := w.w.Write(p[start:i]); err != nil {
+				return start, err
+			}
+			if _, err := w.w.Write([]byte("\r")); err != nil {
+				return i, err
+			}
+			start = i
+		}
+		w.prev = b
+	}
+	if _, err := w.w.Write(p[start:]); err != nil {
+		return start, err
+	}
+	return len(p), nil
+}
+
+// End terminates the last line, so the message ends in CRLF as DotWriter
+// ends it on Close
+func (w *CRLFWriter) End() error {
+	var eol string
+	switch w.prev {
+	case '\n':
+		return nil
+	case '\r':
+		eol = "\n"
+	default:
+		eol = "\r\n"
+	}
+	_, err := w.w.Write([]byte(eol))
+	return err
+}
+
 var testHookStartTLS func(*tls.Config) // nil, except for tests
 
 // SendMail connects to the server at addr, switches to TLS if
@@ -271,6 +465,13 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // and then sends an email from address from, to addresses to, with
 // message msg.
 func SendMail(addr string, a Auth, from string, to []string, msg []byte, host string) error {
+	return SendMailReader(addr, a, from, to, bytes.NewReader(msg), host, nil)
+}
+
+// SendMailReader is like SendMail but streams the message from msg. The
+// message is sent with BDAT if the server supports CHUNKING; a binary
+// message, as told by opts, can't be sent any other way.
+func SendMailReader(addr string, a Auth, from string, to []string, msg io.Reader, host string, opts *MailOptions) error {
 	c, err := Dial(addr)
 	if err != nil {
 		return err
@@ -300,19 +501,40 @@ func SendMail(addr string, a Auth, from string, to []string, msg []byte, host st
 			}
 		}
 	}
-	if err = c.Mail(from); err != nil {
+	if err = c.MailWithOptions(from, opts); err != nil {
 		return err
 	}
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
+		var rcptOpts *RcptOptions
+		if opts != nil {
+			if o, ok := opts.Recipients[addr]; ok {
+				rcptOpts = &o
+			}
+		}
+		if err = c.RcptWithOptions(addr, rcptOpts); err != nil {
 			return err
 		}
 	}
-	w, err := c.Data()
+	if opts != nil {
+		opts.DSNDropped = !c.hasExt("DSN")
+	}
+	var w io.WriteCloser
+	if c.hasExt("CHUNKING") {
+		w, err = c.Bdat()
+	} else {
+		w, err = c.Data()
+	}
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(msg)
+	if _, ok := w.(*bdatWriter); ok && (opts == nil || !opts.BinaryMIME) {
+		cw := NewCRLFWriter(w)
+		if _, err = io.Copy(cw, msg); err == nil {
+			err = cw.End()
+		}
+	} else {
+		_, err = io.Copy(w, msg)
+	}
 	if err != nil {
 		return err
 	}
@@ -3,6 +3,7 @@ package smtpd
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 func parseAddress(src string) (string, error) {
@@ -21,3 +22,13 @@ func parseAddress(src string) (string, error) {
 
 	return src[1 : len(src)-1], nil
 }
+
+// IsASCII reports whether addr can be used without SMTPUTF8
+func IsASCII(addr string) bool {
+	for i := 0; i < len(addr); i++ {
+		if addr[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
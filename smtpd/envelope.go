@@ -2,16 +2,32 @@ package smtpd
 
 import (
 	"crypto/tls"
-	//	"fmt"
-	//	"strings"
-	//	"time"
+	"fmt"
+	"net"
+	"smtprelay/spool"
+	"time"
 )
 
 // Envelope holds a message
 type Envelope struct {
+	QueueID    string // Assigned by Server.QueueID when the message data is complete
 	Sender     string
 	Recipients []string
-	Data       []byte
+	Data       []byte      // Message data, only set if it was kept in memory
+	Body       *spool.Body // Message data, in memory or spooled to disk
+	BodyType   string      // BODY parameter of MAIL FROM, empty if not given
+	SMTPUTF8   bool        // Client asked for SMTPUTF8 (RFC 6531)
+
+	// Delivery status notification parameters (RFC 3461)
+	Ret   string                  // RET parameter of MAIL FROM, FULL or HDRS
+	EnvID string                  // ENVID parameter of MAIL FROM, xtext encoded
+	DSN   map[string]RecipientDSN // NOTIFY and ORCPT parameters by recipient
+}
+
+// RecipientDSN holds the RFC 3461 parameters of one RCPT TO
+type RecipientDSN struct {
+	Notify []string // NEVER, or any of SUCCESS, FAILURE and DELAY
+	ORcpt  string   // ORCPT parameter, xtext encoded, e.g. "rfc822;user@example.com"
 }
 
 var tlsVersions = map[uint16]string{
@@ -19,33 +35,71 @@ var tlsVersions = map[uint16]string{
 	tls.VersionTLS10: "TLS1.0",
 	tls.VersionTLS11: "TLS1.1",
 	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
 }
 
-// AddReceivedLine prepends a Received header to the Data
-/*func (env *Envelope) AddReceivedLine(peer Peer) {
-	tlsDetails := ""
+// ReceivedLine returns a Received header (RFC 5321) for a message from
+// peer, naming the queue ID id unless it is empty
+func ReceivedLine(peer Peer, id string) []byte {
+	from := "[" + peer.Addr.String() + "]"
+	if host, _, err := net.SplitHostPort(peer.Addr.String()); err == nil {
+		from = "[" + host + "]"
+	}
+	if peer.HeloName != "" {
+		from = peer.HeloName + " " + from
+	}
+
+	// RFC 3848 protocol names for mail over TLS and from AUTH users
+	with := string(peer.Protocol)
+	if peer.Protocol == ESMTP {
+		if peer.TLS != nil {
+			with += "S"
+		}
+		if peer.Username != "" {
+			with += "A"
+		}
+	}
+	if id != "" {
+		with += " id " + id
+	}
+
+	details := ""
 
 	if peer.TLS != nil {
-		tlsDetails = fmt.Sprintf(
-			"\r\n\t(version=%s cipher=0x%x);",
+		details += fmt.Sprintf(
+			"\r\n\t(version=%s cipher=%s)",
 			tlsVersions[peer.TLS.Version],
-			peer.TLS.CipherSuite,
+			tls.CipherSuiteName(peer.TLS.CipherSuite),
 		)
 	}
 
-	line := wrap([]byte(fmt.Sprintf(
-		"Received: from %s [%s] by %s with %s;%s\r\n\t%s\r\n",
-		peer.HeloName,
-		strings.Split(peer.Addr.String(), ":")[0],
+	if peer.Username != "" {
+		details += fmt.Sprintf("\r\n\t(authenticated as %s)", peer.Username)
+	}
+
+	return wrap([]byte(fmt.Sprintf(
+		"Received: from %s by %s with %s%s;\r\n\t%s\r\n",
+		from,
 		peer.ServerName,
-		peer.Protocol,
-		tlsDetails,
-		time.Now().Format("Mon Jan 2 15:04:05 -0700 2006"),
+		with,
+		details,
+		time.Now().Format(time.RFC1123Z),
 	)))
+}
 
-	env.Data = append(env.Data, line...)
+// AddReceivedLine prepends a Received header to the message
+func (env *Envelope) AddReceivedLine(peer Peer) {
+	env.PrependHeader(ReceivedLine(peer, ""))
+}
 
-	// Move the new Received line up front
-	copy(env.Data[len(line):], env.Data[0:len(env.Data)-len(line)])
-	copy(env.Data, line)
-}*/
+// PrependHeader puts header, complete with its line end, in front of the
+// message
+func (env *Envelope) PrependHeader(header []byte) {
+	if env.Body == nil {
+		env.Body = spool.NewBody(env.Data)
+	}
+	env.Body.Prepend(header)
+	if env.Body.InMemory() {
+		env.Data, _ = env.Body.Bytes()
+	}
+}
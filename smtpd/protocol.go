@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/textproto"
+	"smtprelay/spool"
 	"strconv"
 	"strings"
 	"time"
@@ -38,6 +40,39 @@ func parseLine(line string) command {
 	return cmd
 }
 
+// parseParameters parses the ESMTP KEY=VALUE parameters following a MAIL or
+// RCPT address. Keys are upper-cased; keywords without a value map to "".
+func parseParameters(fields []string) map[string]string {
+	params := make(map[string]string)
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		} else {
+			params[strings.ToUpper(kv[0])] = ""
+		}
+	}
+	return params
+}
+
+// parseNotify parses the NOTIFY parameter of RCPT TO, either NEVER or a
+// list of SUCCESS, FAILURE and DELAY
+func parseNotify(value string) ([]string, error) {
+	notify := strings.Split(strings.ToUpper(value), ",")
+	for _, n := range notify {
+		switch n {
+		case "NEVER":
+			if len(notify) > 1 {
+				return nil, errors.New("NEVER can't be combined")
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return nil, fmt.Errorf("unknown NOTIFY value %s", n)
+		}
+	}
+	return notify, nil
+}
+
 func (session *session) handle(line string) {
 	cmd := parseLine(line)
 
@@ -57,6 +92,8 @@ func (session *session) handle(line string) {
 		session.handleSTARTTLS(cmd)
 	case "DATA":
 		session.handleDATA(cmd)
+	case "BDAT":
+		session.handleBDAT(cmd)
 	case "RSET":
 		session.handleRSET(cmd)
 	case "NOOP":
@@ -163,6 +200,49 @@ func (session *session) handleMAIL(cmd command) {
 		return
 	}
 
+	params := parseParameters(cmd.fields[2:])
+
+	bodyType := strings.ToUpper(params["BODY"])
+	switch bodyType {
+	case "", "7BIT", "8BITMIME", "BINARYMIME":
+	default:
+		session.reply(501, "Unsupported BODY type")
+		return
+	}
+
+	if size, found := params["SIZE"]; found {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			session.reply(501, "Invalid SIZE parameter")
+			return
+		}
+		if n > int64(session.server.MaxMessageSize) {
+			session.reply(552, fmt.Sprintf(
+				"5.3.4  Message size exceeds maximum of %d bytes",
+				session.server.MaxMessageSize,
+			))
+			return
+		}
+	}
+
+	ret := strings.ToUpper(params["RET"])
+	if ret != "" && ret != "FULL" && ret != "HDRS" {
+		session.reply(501, "Invalid RET parameter")
+		return
+	}
+
+	envID, hasEnvID := params["ENVID"]
+	if hasEnvID && (envID == "" || len(envID) > 100) {
+		session.reply(501, "Invalid ENVID parameter")
+		return
+	}
+
+	_, smtpUTF8 := params["SMTPUTF8"]
+	if !smtpUTF8 && !IsASCII(addr) {
+		session.reply(553, "5.6.7  Non-ASCII address requires SMTPUTF8")
+		return
+	}
+
 	if session.server.SenderChecker != nil {
 		err = session.server.SenderChecker(session.peer, addr)
 		if err != nil {
@@ -172,7 +252,11 @@ func (session *session) handleMAIL(cmd command) {
 	}
 
 	session.envelope = &Envelope{
-		Sender: addr,
+		Sender:   addr,
+		BodyType: bodyType,
+		SMTPUTF8: smtpUTF8,
+		Ret:      ret,
+		EnvID:    envID,
 	}
 
 	session.reply(250, "Go ahead")
@@ -203,6 +287,31 @@ func (session *session) handleRCPT(cmd command) {
 		return
 	}
 
+	if !session.envelope.SMTPUTF8 && !IsASCII(addr) {
+		session.reply(553, "5.6.7  Non-ASCII address requires SMTPUTF8")
+		return
+	}
+
+	params := parseParameters(cmd.fields[2:])
+
+	var dsn RecipientDSN
+
+	if notify, found := params["NOTIFY"]; found {
+		dsn.Notify, err = parseNotify(notify)
+		if err != nil {
+			session.reply(501, "Invalid NOTIFY parameter")
+			return
+		}
+	}
+
+	if orcpt, found := params["ORCPT"]; found {
+		if !strings.Contains(orcpt, ";") {
+			session.reply(501, "Invalid ORCPT parameter")
+			return
+		}
+		dsn.ORcpt = orcpt
+	}
+
 	if session.server.RecipientChecker != nil {
 		err = session.server.RecipientChecker(session.peer, addr)
 		if err != nil {
@@ -213,6 +322,13 @@ func (session *session) handleRCPT(cmd command) {
 
 	session.envelope.Recipients = append(session.envelope.Recipients, addr)
 
+	if dsn.Notify != nil || dsn.ORcpt != "" {
+		if session.envelope.DSN == nil {
+			session.envelope.DSN = make(map[string]RecipientDSN)
+		}
+		session.envelope.DSN[addr] = dsn
+	}
+
 	session.reply(250, "Go ahead")
 
 	return
@@ -249,7 +365,6 @@ func (session *session) handleSTARTTLS(cmd command) {
 	session.conn = tlsConn
 	session.reader = bufio.NewReader(tlsConn)
 	session.writer = bufio.NewWriter(tlsConn)
-	session.scanner = bufio.NewScanner(session.reader)
 	session.tls = true
 
 	// Save connection state on peer
@@ -270,10 +385,15 @@ func (session *session) handleDATA(cmd command) {
 		return
 	}
 
+	if session.chunks != nil || session.envelope.BodyType == "BINARYMIME" {
+		session.reply(503, "Use BDAT to send this message.")
+		return
+	}
+
 	session.reply(354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
 	session.conn.SetDeadline(time.Now().Add(session.server.DataTimeout))
 
-	data := &bytes.Buffer{}
+	data := spool.NewWriter(session.server.SpoolDir, int64(session.server.SpoolThreshold))
 	reader := textproto.NewReader(session.reader).DotReader()
 
 	_, err := io.CopyN(data, reader, int64(session.server.MaxMessageSize))
@@ -283,19 +403,15 @@ func (session *session) handleDATA(cmd command) {
 		// EOF was reached before MaxMessageSize
 		// Accept and deliver message
 
-		session.envelope.Data = data.Bytes()
-
-		if err := session.deliver(); err != nil {
-			session.error(err)
-		} else {
-			session.reply(250, "Thank you.")
-		}
-
-		session.reset()
+		session.deliverBody(data)
+		return
 
 	}
 
-	if err != nil {
+	spoolErr := data.Err()
+	data.Discard()
+
+	if err != nil && spoolErr == nil {
 		// Network error, ignore
 		return
 	}
@@ -308,10 +424,14 @@ func (session *session) handleDATA(cmd command) {
 		return
 	}
 
-	session.reply(552, fmt.Sprintf(
-		"Message exceeded max message size of %d bytes",
-		session.server.MaxMessageSize,
-	))
+	if spoolErr != nil {
+		session.reply(451, "4.3.0  Error storing message")
+	} else {
+		session.reply(552, fmt.Sprintf(
+			"Message exceeded max message size of %d bytes",
+			session.server.MaxMessageSize,
+		))
+	}
 
 	session.reset()
 
@@ -319,6 +439,118 @@ func (session *session) handleDATA(cmd command) {
 
 }
 
+// deliverBody hands the collected message data to the handler and ends the
+// transaction
+func (session *session) deliverBody(data *spool.Writer) {
+
+	body, err := data.Body()
+	if err != nil {
+		session.reply(451, "4.3.0  Error storing message")
+		session.reset()
+		return
+	}
+
+	session.envelope.Body = body
+	if body.InMemory() {
+		session.envelope.Data, _ = body.Bytes()
+	}
+
+	if session.server.QueueID != nil {
+		session.envelope.QueueID = session.server.QueueID()
+	}
+
+	if err := session.deliver(); err != nil {
+		session.error(err)
+	} else if session.envelope.QueueID != "" {
+		session.reply(250, fmt.Sprintf("2.0.0  Ok: queued as %s", session.envelope.QueueID))
+	} else {
+		session.reply(250, "Thank you.")
+	}
+
+	body.Release()
+	session.reset()
+
+}
+
+func (session *session) handleBDAT(cmd command) {
+
+	if len(cmd.fields) < 2 || len(cmd.fields) > 3 {
+		session.reply(501, "Syntax: BDAT <size> [LAST]")
+		return
+	}
+
+	size, err := strconv.ParseInt(cmd.fields[1], 10, 64)
+	if err != nil || size < 0 {
+		session.reply(501, "Invalid chunk size")
+		return
+	}
+
+	last := false
+	if len(cmd.fields) == 3 {
+		if strings.ToUpper(cmd.fields[2]) != "LAST" {
+			session.reply(501, "Syntax: BDAT <size> [LAST]")
+			return
+		}
+		last = true
+	}
+
+	// The chunk has to be read even if it is rejected, or it would be taken
+	// for commands.
+	session.conn.SetDeadline(time.Now().Add(session.server.DataTimeout))
+	chunk := io.LimitReader(session.reader, size)
+
+	if session.envelope == nil || len(session.envelope.Recipients) == 0 {
+		if _, err := io.Copy(ioutil.Discard, chunk); err != nil {
+			// Network error, ignore
+			return
+		}
+		session.reply(502, "Missing RCPT TO command.")
+		return
+	}
+
+	if session.chunks == nil {
+		session.chunks = spool.NewWriter(session.server.SpoolDir, int64(session.server.SpoolThreshold))
+	}
+
+	if session.chunks.Len()+size > int64(session.server.MaxMessageSize) {
+		if _, err := io.Copy(ioutil.Discard, chunk); err != nil {
+			return
+		}
+		session.reset()
+		session.reply(552, fmt.Sprintf(
+			"Message exceeded max message size of %d bytes",
+			session.server.MaxMessageSize,
+		))
+		return
+	}
+
+	n, err := io.Copy(session.chunks, chunk)
+
+	if spoolErr := session.chunks.Err(); spoolErr != nil {
+		if _, err := io.Copy(ioutil.Discard, chunk); err != nil {
+			return
+		}
+		session.reset()
+		session.reply(451, "4.3.0  Error storing message")
+		return
+	}
+
+	if err != nil || n < size {
+		// Network error, ignore
+		return
+	}
+
+	if !last {
+		session.reply(250, fmt.Sprintf("%d octets received", size))
+		return
+	}
+
+	data := session.chunks
+	session.chunks = nil
+	session.deliverBody(data)
+
+}
+
 func (session *session) handleRSET(cmd command) {
 	session.reset()
 	session.reply(250, "Go ahead")
@@ -366,10 +598,11 @@ func (session *session) handleAUTH(cmd command) {
 
 		if len(cmd.fields) < 3 {
 			session.reply(334, "Give me your credentials")
-			if !session.scanner.Scan() {
+			line, err := session.readLine()
+			if err != nil {
 				return
 			}
-			auth = session.scanner.Text()
+			auth = line
 		} else {
 			auth = cmd.fields[2]
 		}
@@ -395,11 +628,12 @@ func (session *session) handleAUTH(cmd command) {
 
 		session.reply(334, "VXNlcm5hbWU6")
 
-		if !session.scanner.Scan() {
+		line, err := session.readLine()
+		if err != nil {
 			return
 		}
 
-		byteUsername, err := base64.StdEncoding.DecodeString(session.scanner.Text())
+		byteUsername, err := base64.StdEncoding.DecodeString(line)
 
 		if err != nil {
 			session.reply(502, "Couldn't decode your credentials")
@@ -408,11 +642,12 @@ func (session *session) handleAUTH(cmd command) {
 
 		session.reply(334, "UGFzc3dvcmQ6")
 
-		if !session.scanner.Scan() {
+		line, err = session.readLine()
+		if err != nil {
 			return
 		}
 
-		bytePassword, err := base64.StdEncoding.DecodeString(session.scanner.Text())
+		bytePassword, err := base64.StdEncoding.DecodeString(line)
 
 		if err != nil {
 			session.reply(502, "Couldn't decode your credentials")
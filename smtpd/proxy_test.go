@@ -0,0 +1,88 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+
+	cases := map[string]string{
+		"PROXY TCP4 192.0.2.10 198.51.100.1 56324 25\r\nEHLO": "192.0.2.10:56324",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 4000 587\r\nEHLO": "[2001:db8::1]:4000",
+		"PROXY UNKNOWN\r\nEHLO":                               "",
+	}
+
+	for header, expected := range cases {
+		r := bufio.NewReader(bytes.NewBufferString(header))
+		addr, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Fatalf("ReadProxyHeader(%q) failed: %v", header, err)
+		}
+		if got := addrString(addr); got != expected {
+			t.Fatalf("ReadProxyHeader(%q) = %q, expected %q", header, got, expected)
+		}
+		if rest, _ := r.ReadString(0); rest != "EHLO" {
+			t.Fatalf("ReadProxyHeader(%q) consumed too much, left %q", header, rest)
+		}
+	}
+
+	for _, header := range []string{
+		"EHLO foo\r\n",
+		"PROXY TCP4 192.0.2.10 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.10 198.51.100.1 56324 25\n",
+	} {
+		if _, err := ReadProxyHeader(bufio.NewReader(bytes.NewBufferString(header))); err == nil {
+			t.Fatalf("ReadProxyHeader(%q) didn't fail", header)
+		}
+	}
+
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+
+	header := func(command, family byte, payload []byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x20|command, family, 0, 0)
+		binary.BigEndian.PutUint16(b[14:16], uint16(len(payload)))
+		return append(append(b, payload...), "EHLO"...)
+	}
+
+	ipv4 := []byte{192, 0, 2, 10, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	ipv4 = append(ipv4, 0x04, 0, 1, 0) // TLV, skipped
+
+	cases := map[string][]byte{
+		"192.0.2.10:56324": header(1, 0x11, ipv4),
+		"":                 header(0, 0x00, nil),
+	}
+
+	for expected, data := range cases {
+		r := bufio.NewReader(bytes.NewReader(data))
+		addr, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Fatalf("ReadProxyHeader failed: %v", err)
+		}
+		if got := addrString(addr); got != expected {
+			t.Fatalf("ReadProxyHeader = %q, expected %q", got, expected)
+		}
+		if rest, _ := r.ReadString(0); rest != "EHLO" {
+			t.Fatalf("ReadProxyHeader consumed too much, left %q", rest)
+		}
+	}
+
+	if _, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(header(1, 0x11, ipv4[:8])))); err == nil {
+		t.Fatal("ReadProxyHeader didn't fail on short address block")
+	}
+
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
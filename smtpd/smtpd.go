@@ -9,6 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"smtprelay/spool"
+	"strings"
 	"time"
 )
 
@@ -25,11 +28,19 @@ type Server struct {
 	MaxMessageSize int // Max message size in bytes. (default: 10240000)
 	MaxRecipients  int // Max RCPT TO calls for each envelope. (default: 100)
 
+	SpoolDir       string // Directory for message data above SpoolThreshold. (default: os.TempDir())
+	SpoolThreshold int    // Message data kept in memory, in bytes. (default: 1048576)
+
 	// New e-mails are handed off to this function.
 	// Can be left empty for a NOOP server.
 	// If an error is returned, it will be reported in the SMTP session.
 	Handler func(peer Peer, env Envelope) error
 
+	// Assigns Envelope.QueueID before the Handler is called. The ID is
+	// reported in the reply to an accepted message.
+	// Can be left empty for no queue IDs.
+	QueueID func() string
+
 	// Enable various checks during the SMTP session.
 	// Can be left empty for no restrictions.
 	// If an error is returned, it will be reported in the SMTP session.
@@ -45,7 +56,12 @@ type Server struct {
 
 	EnableXCLIENT bool // Enable XCLIENT support (default: false)
 
-	TLSConfig *tls.Config // Enable STARTTLS support.
+	// Expect a PROXY protocol v1/v2 header on connections for which this
+	// returns true, and use its source address as Peer.Addr.
+	// Can be left empty to disable PROXY protocol support.
+	ProxyProtocolChecker func(addr net.Addr) bool
+
+	TLSConfig *tls.Config // Enable STARTTLS support, required by ServeTLS.
 	ForceTLS  bool        // Force STARTTLS usage.
 }
 
@@ -85,25 +101,31 @@ type session struct {
 
 	conn net.Conn
 
-	reader  *bufio.Reader
-	writer  *bufio.Writer
-	scanner *bufio.Scanner
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	// Message data received by BDAT so far
+	chunks *spool.Writer
 
-	tls bool
+	tls         bool
+	implicitTLS bool
 }
 
+// Longest command line accepted, like the bufio.Scanner default
+const maxLineLength = 64 * 1024
+
+var errLineTooLong = errors.New("line too long")
+
 func (srv *Server) newSession(c net.Conn) *session {
-	reader := bufio.NewReader(c)
 	return &session{
 		server: srv,
 		conn:   c,
-		reader: reader,
+		reader: bufio.NewReader(c),
 		writer: bufio.NewWriter(c),
 		peer: Peer{
 			Addr:       c.RemoteAddr(),
 			ServerName: srv.Hostname,
 		},
-		scanner: bufio.NewScanner(reader),
 	}
 }
 
@@ -122,8 +144,38 @@ func (srv *Server) ListenAndServe(addr string) error {
 	return srv.Serve(l)
 }
 
+// ListenAndServeTLS starts the SMTP server with implicit TLS (SMTPS) on
+// the address provided
+func (srv *Server) ListenAndServeTLS(addr string) error {
+	err := srv.configureDefaults()
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.ServeTLS(l)
+}
+
 // Serve starts the SMTP server and listens on the Listener provided
 func (srv *Server) Serve(l net.Listener) error {
+	return srv.serve(l, false)
+}
+
+// ServeTLS starts the SMTP server with implicit TLS on the Listener
+// provided. The TLS handshake is done in the session goroutine, so a slow
+// client doesn't hold up Accept.
+func (srv *Server) ServeTLS(l net.Listener) error {
+	if srv.TLSConfig == nil {
+		return errors.New("Cannot use ServeTLS with no TLSConfig")
+	}
+	return srv.serve(l, true)
+}
+
+func (srv *Server) serve(l net.Listener, implicitTLS bool) error {
 	err := srv.configureDefaults()
 	if err != nil {
 		return err
@@ -148,6 +200,7 @@ func (srv *Server) Serve(l net.Listener) error {
 		}
 
 		session := srv.newSession(conn)
+		session.implicitTLS = implicitTLS
 
 		if limiter == nil {
 			go session.serve()
@@ -178,6 +231,14 @@ func (srv *Server) configureDefaults() error {
 		srv.MaxRecipients = 100
 	}
 
+	if srv.SpoolDir == "" {
+		srv.SpoolDir = os.TempDir()
+	}
+
+	if srv.SpoolThreshold == 0 {
+		srv.SpoolThreshold = spool.DefaultThreshold
+	}
+
 	if srv.ReadTimeout == 0 {
 		srv.ReadTimeout = time.Second * 60
 	}
@@ -207,35 +268,93 @@ func (srv *Server) configureDefaults() error {
 func (session *session) serve() {
 	defer session.close()
 
+	if session.server.ProxyProtocolChecker != nil && session.server.ProxyProtocolChecker(session.peer.Addr) {
+		session.conn.SetReadDeadline(time.Now().Add(session.server.ReadTimeout))
+		addr, err := ReadProxyHeader(session.reader)
+		if err != nil {
+			return
+		}
+		if addr != nil {
+			session.peer.Addr = addr
+		}
+	}
+
+	if session.implicitTLS {
+		tlsConn := tls.Server(&bufferedConn{session.conn, session.reader}, session.server.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(session.server.ReadTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		session.conn = tlsConn
+		session.reader = bufio.NewReader(tlsConn)
+		session.writer = bufio.NewWriter(tlsConn)
+		session.tls = true
+		state := tlsConn.ConnectionState()
+		session.peer.TLS = &state
+	}
+
 	session.welcome()
 	for {
-		for session.scanner.Scan() {
-			session.handle(session.scanner.Text())
-		}
+		line, err := session.readLine()
 
-		if err := session.scanner.Err(); err == bufio.ErrTooLong {
+		if err == errLineTooLong {
 			session.reply(500, "Line too long")
 
-			// Advance reader to the next newline
-			session.reader.ReadString('\n')
-			session.scanner = bufio.NewScanner(session.reader)
-
 			// Reset and have the client start over.
 			session.reset()
 			continue
 		}
 
-		break
+		if err != nil {
+			break
+		}
+
+		session.handle(line)
+	}
+}
+
+// readLine reads a line without its line end. Unlike a bufio.Scanner it
+// doesn't read ahead, so BDAT data following a command stays in the
+// session reader.
+func (session *session) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := session.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLength {
+			// Advance reader to the next newline
+			for err == bufio.ErrBufferFull {
+				_, err = session.reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
 	}
 }
 
 func (session *session) reject() {
-	session.reply(421, "Too busy. Try again later.")
+	if !session.implicitTLS {
+		session.reply(421, "Too busy. Try again later.")
+	}
 	session.close()
 }
 
 func (session *session) reset() {
 	session.envelope = nil
+	if session.chunks != nil {
+		session.chunks.Discard()
+		session.chunks = nil
+	}
 }
 
 func (session *session) welcome() {
@@ -275,6 +394,10 @@ func (session *session) extensions() []string {
 		fmt.Sprintf("SIZE %d", session.server.MaxMessageSize),
 		"8BITMIME",
 		"PIPELINING",
+		"CHUNKING",
+		"BINARYMIME",
+		"SMTPUTF8",
+		"DSN",
 	}
 
 	if session.server.EnableXCLIENT {
@@ -300,6 +423,7 @@ func (session *session) deliver() error {
 }
 
 func (session *session) close() {
+	session.reset()
 	session.writer.Flush()
 	time.Sleep(200 * time.Millisecond)
 	session.conn.Close()
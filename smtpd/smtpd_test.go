@@ -269,6 +269,60 @@ func TestSTARTTLS(t *testing.T) {
 	}
 }
 
+func TestServeTLS(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("Cert load failed: %v", err)
+	}
+
+	server := &smtpd.Server{
+		Authenticator: func(peer smtpd.Peer, username, password string) error { return nil },
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		server.ServeTLS(ln)
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	c, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("HELO failed: %v", err)
+	}
+
+	if supported, _ := c.Extension("STARTTLS"); supported {
+		t.Fatal("STARTTLS offered on implicit TLS connection")
+	}
+
+	if supported, _ := c.Extension("AUTH"); !supported {
+		t.Fatal("AUTH not supported on implicit TLS connection")
+	}
+
+	if err := c.Auth(smtp.PlainAuth("foo", "foo", "bar", "127.0.0.1")); err != nil {
+		t.Fatalf("Auth failed: %v", err)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit failed: %v", err)
+	}
+}
+
 func TestAuthRejection(t *testing.T) {
 	addr, closer := runsslserver(t, &smtpd.Server{
 		Authenticator: func(peer smtpd.Peer, username, password string) error {
@@ -440,6 +494,38 @@ func TestMaxMessageSize(t *testing.T) {
 	}
 }
 
+func TestMailSizeParameter(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxMessageSize: 100,
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("HELO failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 501, "MAIL FROM:<sender@example.org> SIZE=big"); err != nil {
+		t.Fatalf("MAIL didn't fail on invalid SIZE: %v", err)
+	}
+
+	if err := cmd(c.Text, 552, "MAIL FROM:<sender@example.org> SIZE=101"); err != nil {
+		t.Fatalf("MAIL didn't reject oversized message: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "MAIL FROM:<sender@example.org> SIZE=100"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+}
+
 func TestHandler(t *testing.T) {
 	addr, closer := runserver(t, &smtpd.Server{
 		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
@@ -493,6 +579,271 @@ func TestHandler(t *testing.T) {
 	}
 }
 
+func TestSpooledBody(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		SpoolThreshold: 8,
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			if env.Body.InMemory() || env.Data != nil {
+				t.Fatal("Message body not spooled to disk")
+			}
+			data, err := env.Body.Bytes()
+			if err != nil {
+				t.Fatalf("Reading spooled body failed: %v", err)
+			}
+			if string(data) != "This is the email body\n" {
+				t.Fatalf("Wrong message body: %v", string(data))
+			}
+			return nil
+		},
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := c.Rcpt("recipient@example.net"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	_, err = fmt.Fprintf(wc, "This is the email body")
+	if err != nil {
+		t.Fatalf("Data body failed: %v", err)
+	}
+
+	err = wc.Close()
+	if err != nil {
+		t.Fatalf("Data close failed: %v", err)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+}
+
+func TestBDAT(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxMessageSize: 32,
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			if env.BodyType != "BINARYMIME" {
+				t.Fatalf("Wrong body type: %v", env.BodyType)
+			}
+			if string(env.Data) != "Binary\x00body\r\nLAST\r\n" {
+				t.Fatalf("Wrong message body: %q", env.Data)
+			}
+			return nil
+		},
+	})
+	defer closer()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	c := textproto.NewConn(conn)
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Welcome failed: %v", err)
+	}
+
+	if err := cmd(c, 250, "EHLO localhost"); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+
+	if err := cmd(c, 501, "MAIL FROM:<sender@example.org> BODY=BASE64"); err != nil {
+		t.Fatalf("MAIL didn't fail on unknown BODY: %v", err)
+	}
+
+	if err := cmd(c, 250, "MAIL FROM:<sender@example.org> BODY=BINARYMIME"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := cmd(c, 250, "RCPT TO:<recipient@example.net>"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	if err := cmd(c, 503, "DATA"); err != nil {
+		t.Fatalf("DATA didn't fail for BINARYMIME: %v", err)
+	}
+
+	// Cmd ends every chunk with the CRLF counted in its size
+	if err := cmd(c, 250, "BDAT 13\r\nBinary\x00body"); err != nil {
+		t.Fatalf("BDAT failed: %v", err)
+	}
+
+	if err := cmd(c, 250, "BDAT 6 LAST\r\nLAST"); err != nil {
+		t.Fatalf("BDAT LAST failed: %v", err)
+	}
+
+	// The oversized chunk is read and dropped, so the session goes on
+	if err := cmd(c, 250, "MAIL FROM:<sender@example.org>"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := cmd(c, 250, "RCPT TO:<recipient@example.net>"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	if err := cmd(c, 552, "BDAT 35 LAST\r\n%s", strings.Repeat("x", 33)); err != nil {
+		t.Fatalf("BDAT didn't fail on oversized message: %v", err)
+	}
+
+	if err := cmd(c, 502, "BDAT 4 LAST\r\nxx"); err != nil {
+		t.Fatalf("BDAT didn't fail without a transaction: %v", err)
+	}
+
+	if err := cmd(c, 221, "QUIT"); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+
+	conn.Close()
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			if !env.SMTPUTF8 {
+				t.Fatal("SMTPUTF8 not set on envelope")
+			}
+			if env.Recipients[0] != "пользователь@пример.рф" {
+				t.Fatalf("Wrong recipient: %v", env.Recipients[0])
+			}
+			return nil
+		},
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if supported, _ := c.Extension("SMTPUTF8"); !supported {
+		t.Fatal("SMTPUTF8 not supported")
+	}
+
+	if err := cmd(c.Text, 553, "MAIL FROM:<отправитель@пример.рф>"); err != nil {
+		t.Fatalf("MAIL didn't fail without SMTPUTF8: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "MAIL FROM:<sender@example.org>"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 553, "RCPT TO:<пользователь@пример.рф>"); err != nil {
+		t.Fatalf("RCPT didn't fail without SMTPUTF8: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "RSET"); err != nil {
+		t.Fatalf("RSET failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "MAIL FROM:<sender@example.org> SMTPUTF8"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "RCPT TO:<пользователь@пример.рф>"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	_, err = fmt.Fprintf(wc, "This is the email body")
+	if err != nil {
+		t.Fatalf("Data body failed: %v", err)
+	}
+
+	err = wc.Close()
+	if err != nil {
+		t.Fatalf("Data close failed: %v", err)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+}
+
+func TestDSNParameters(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			if env.Ret != "HDRS" || env.EnvID != "QQ314159" {
+				t.Fatalf("Wrong envelope parameters: %v %v", env.Ret, env.EnvID)
+			}
+			dsn, found := env.DSN["recipient@example.net"]
+			if !found || strings.Join(dsn.Notify, ",") != "SUCCESS,FAILURE" || dsn.ORcpt != "rfc822;recipient@example.net" {
+				t.Fatalf("Wrong recipient parameters: %v", env.DSN)
+			}
+			if _, found := env.DSN["other@example.net"]; found {
+				t.Fatal("Parameters for recipient without any")
+			}
+			return nil
+		},
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if supported, _ := c.Extension("DSN"); !supported {
+		t.Fatal("DSN not supported")
+	}
+
+	if err := cmd(c.Text, 501, "MAIL FROM:<sender@example.org> RET=BODY"); err != nil {
+		t.Fatalf("MAIL didn't fail on invalid RET: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "MAIL FROM:<sender@example.org> RET=hdrs ENVID=QQ314159"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 501, "RCPT TO:<recipient@example.net> NOTIFY=NEVER,SUCCESS"); err != nil {
+		t.Fatalf("RCPT didn't fail on invalid NOTIFY: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "RCPT TO:<recipient@example.net> NOTIFY=success,failure ORCPT=rfc822;recipient@example.net"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "RCPT TO:<other@example.net>"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	_, err = fmt.Fprintf(wc, "This is the email body")
+	if err != nil {
+		t.Fatalf("Data body failed: %v", err)
+	}
+
+	err = wc.Close()
+	if err != nil {
+		t.Fatalf("Data close failed: %v", err)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+}
+
 func TestRejectHandler(t *testing.T) {
 	addr, closer := runserver(t, &smtpd.Server{
 		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
@@ -870,12 +1221,47 @@ func TestXCLIENT(t *testing.T) {
 	}
 }
 
+func TestProxyProtocol(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		ProxyProtocolChecker: func(addr net.Addr) bool { return true },
+		ConnectionChecker: func(peer smtpd.Peer) error {
+			if peer.Addr.String() != "42.42.42.42:4242" {
+				t.Fatalf("Didn't override IP/Port: %v", peer.Addr)
+			}
+			return nil
+		},
+	})
+	defer closer()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if _, err := fmt.Fprintf(conn, "PROXY TCP4 42.42.42.42 127.0.0.1 4242 25\r\n"); err != nil {
+		t.Fatalf("PROXY header failed: %v", err)
+	}
+
+	c, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("HELO failed: %v", err)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit failed: %v", err)
+	}
+}
+
 func TestEnvelopeReceived(t *testing.T) {
 	addr, closer := runsslserver(t, &smtpd.Server{
 		Hostname: "foobar.example.net",
 		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
 			env.AddReceivedLine(peer)
-			if !bytes.HasPrefix(env.Data, []byte("Received: from localhost [127.0.0.1] by foobar.example.net with ESMTP;")) {
+			if !bytes.HasPrefix(env.Data, []byte("Received: from localhost [127.0.0.1] by foobar.example.net with ESMTPS\r\n\t(version=")) {
 				t.Fatal("Wrong received line.")
 			}
 			return nil
@@ -921,6 +1307,79 @@ func TestEnvelopeReceived(t *testing.T) {
 	}
 }
 
+func TestReceivedLine(t *testing.T) {
+	peer := smtpd.Peer{
+		HeloName:   "localhost",
+		Protocol:   smtpd.ESMTP,
+		ServerName: "foobar.example.net",
+		Addr:       &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242},
+	}
+	line := string(smtpd.ReceivedLine(peer, ""))
+	if !strings.HasPrefix(line, "Received: from localhost [127.0.0.1] by foobar.example.net with ESMTP;\r\n\t") {
+		t.Errorf("expect plain ESMTP, got - '%s'", line)
+	}
+
+	peer.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	peer.Username = "alice"
+	line = string(smtpd.ReceivedLine(peer, "0123abcd"))
+	expect := "with ESMTPSA id 0123abcd\r\n\t(version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n\t(authenticated as alice);\r\n\t"
+	if !strings.Contains(line, expect) {
+		t.Errorf("expect '%s', got - '%s'", expect, line)
+	}
+}
+
+func TestQueueID(t *testing.T) {
+	addr, closer := runserver(t, &smtpd.Server{
+		QueueID: func() string { return "0123ABCD" },
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			if env.QueueID != "0123ABCD" {
+				t.Fatalf("Wrong queue ID: %v", env.QueueID)
+			}
+			return nil
+		},
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "HELO localhost"); err != nil {
+		t.Fatalf("HELO failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "MAIL FROM:<sender@example.org>"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 250, "RCPT TO:<recipient@example.net>"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	if err := cmd(c.Text, 354, "DATA"); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	id, err := c.Text.Cmd("This is the email body\r\n.")
+	if err != nil {
+		t.Fatalf("Data body failed: %v", err)
+	}
+	c.Text.StartResponse(id)
+	_, msg, err := c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	if err != nil {
+		t.Fatalf("Data close failed: %v", err)
+	}
+	if msg != "2.0.0  Ok: queued as 0123ABCD" {
+		t.Fatalf("Wrong reply: %v", msg)
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+}
+
 func TestHELO(t *testing.T) {
 	addr, closer := runserver(t, &smtpd.Server{})
 	defer closer()
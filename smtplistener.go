@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"smtprelay/smtpd"
 	"strings"
@@ -9,9 +11,15 @@ import (
 	"time"
 )
 
+const (
+	LISTENER_MODE_PLAIN    = "plain"
+	LISTENER_MODE_STARTTLS = "starttls"
+	LISTENER_MODE_TLS      = "tls"
+)
+
 var (
 	StoppedError = errors.New("Listener stopped")
-	smtpServer   StoppableSMTPServer
+	smtpServers  []*StoppableSMTPServer
 )
 
 type StoppableListener struct {
@@ -21,6 +29,7 @@ type StoppableListener struct {
 
 type StoppableSMTPServer struct {
 	smtpd.Server
+	Profile          ListenerConf
 	OriginalListener net.Listener
 	Listener         *StoppableListener
 	WaitGroup        sync.WaitGroup
@@ -28,7 +37,7 @@ type StoppableSMTPServer struct {
 
 func (server *StoppableSMTPServer) Start() (err error) {
 
-	server.OriginalListener, err = net.Listen("tcp", conf.ListenPort)
+	server.OriginalListener, err = net.Listen("tcp", server.Profile.Address)
 	if err != nil {
 		return
 	}
@@ -38,16 +47,23 @@ func (server *StoppableSMTPServer) Start() (err error) {
 		return
 	}
 
+	serve := server.Serve
+	if server.Profile.Mode == LISTENER_MODE_TLS {
+		serve = server.ServeTLS
+	}
+
+	SetSMTPListenerUp(server.Profile.Name, true)
+	server.WaitGroup.Add(1)
 	go func() {
-		server.WaitGroup.Add(1)
 		defer server.WaitGroup.Done()
-		err = server.Serve(server.Listener)
+		defer SetSMTPListenerUp(server.Profile.Name, false)
+		err := serve(server.Listener)
 		if err != nil {
 			if err != StoppedError {
-				log.Critical("Error while start SMTP server at port %s:%s", conf.ListenPort, err.Error())
+				log.Critical("Error while start SMTP server %s at %s:%s", server.Profile.Name, server.Profile.Address, err.Error())
 				return
 			} else {
-				log.Info("SYSTEM: SMTP listener stopped")
+				log.Info("SYSTEM: SMTP listener %s stopped", server.Profile.Name)
 			}
 
 		}
@@ -56,11 +72,12 @@ func (server *StoppableSMTPServer) Start() (err error) {
 }
 
 func (server *StoppableSMTPServer) Stop() {
-	log.Info("SYSTEM: Stopping SMTP listener")
+	log.Info("SYSTEM: Stopping SMTP listener %s", server.Profile.Name)
+	SetSMTPListenerUp(server.Profile.Name, false)
 	server.Listener.Stop()
-	log.Info("SYSTEM: Waiting for processing existing incoming SMTP connections")
+	log.Info("SYSTEM: Waiting for processing existing incoming SMTP connections on %s", server.Profile.Name)
 	server.WaitGroup.Wait()
-	log.Info("SYSTEM: SMTP server stopped")
+	log.Info("SYSTEM: SMTP server %s stopped", server.Profile.Name)
 }
 
 func NewStoppableListener(l net.Listener) (*StoppableListener, error) {
@@ -102,10 +119,14 @@ func (sl *StoppableListener) Stop() {
 	close(sl.stop)
 }
 
-func smtpHandler(peer smtpd.Peer, env smtpd.Envelope) error {
+func (server *StoppableSMTPServer) smtpHandler(peer smtpd.Peer, env smtpd.Envelope) error {
 	MailHandlersIncreaseCounter(1)
 	defer MailHandlersDecreaseCounter(1)
-	msg, err := ParseMessage(env.Recipients, env.Sender, env.Data)
+	if IntakeThrottled() {
+		log.Warn("message from %s (sender:%s;rcpt:%s) DEFERRED: %s", peer.Addr.String(), env.Sender, strings.Join(env.Recipients, ";"), ErrQueueFull.Error())
+		return ErrQueueFull
+	}
+	msg, err := ParseMessageBody(env.Recipients, env.Sender, env.Body)
 	if err != nil {
 		var rcpt = strings.Join(env.Recipients, ";")
 		log.Error("incorrect msg from %s (sender:%s;rcpt:%s) - %s DROPPED: %s", peer.Addr.String(), env.Sender, rcpt, err.Error(), ErrMessageError.Error())
@@ -113,16 +134,93 @@ func smtpHandler(peer smtpd.Peer, env smtpd.Envelope) error {
 		return ErrMessageError
 	}
 
+	queueId := env.QueueID
+	if queueId == "" {
+		queueId = NewQueueId()
+	}
+	msg.QueueId = queueId
 	log.Info("msg %s from %s RECEIVED", msg.String(), peer.Addr.String())
+	MailReceivedIncreaseCounter(1)
 
-	if len(env.Recipients) > conf.MaxRecipients || len(env.Recipients) == 0 {
-		log.Error("message %s rcpt count limited to %d, DROPPED: %s", msg.String(), conf.MaxRecipients, ErrTooManyRecipients.Error())
+	if len(env.Recipients) > server.MaxRecipients || len(env.Recipients) == 0 {
+		log.Error("message %s rcpt count limited to %d, DROPPED: %s", msg.String(), server.MaxRecipients, ErrTooManyRecipients.Error())
 		MailDroppedIncreaseCounter(1)
 		return ErrTooManyRecipients
 	}
 
+	if err := CheckMessageSender(peer.Username, peer.Addr, &msg); err != nil {
+		log.Error("message %s from %s DROPPED: %s", msg.String(), peer.Addr.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return err
+	}
+
+	if err := CheckRateLimits(RateLimitRequest{
+		Client:       AddrIP(peer.Addr),
+		AuthUser:     peer.Username,
+		SenderDomain: msg.Sender.Domain,
+		Recipients:   len(env.Recipients),
+	}); err != nil {
+		log.Warn("message %s from %s DEFERRED: %s", msg.String(), peer.Addr.String(), err.Error())
+		return err
+	}
+
 	var entries []QueueEntry
 
+	headerContext := HeaderContext{
+		Sender:       env.Sender,
+		SenderDomain: msg.Sender.Domain,
+		MessageId:    msg.MessageId,
+		QueueId:      queueId,
+		AuthUser:     peer.Username,
+		Listener:     server.Profile.Name,
+	}
+	if err := ApplyHeaderRules(env.Body, headerContext); err != nil {
+		log.Error("message %s header rules failed, DROPPED: %s", msg.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return ErrMessageError
+	}
+
+	if err := AddMissingHeaders(env.Body, &msg); err != nil {
+		log.Error("message %s can't add missing headers, DROPPED: %s", msg.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return ErrMessageError
+	}
+
+	sendAfter, err := TakeSendAfter(&msg, env.Body)
+	if err != nil {
+		log.Error("message %s can't read %s, DROPPED: %s", msg.String(), DELIVER_AFTER_HEADER, err.Error())
+		MailDroppedIncreaseCounter(1)
+		return ErrMessageError
+	}
+	if sendAfter.After(time.Now()) {
+		if ScheduledQueueFull(len(msg.RcptDomains)) {
+			log.Warn("message %s DEFERRED: %s", msg.String(), ErrScheduledFull.Error())
+			return ErrScheduledFull
+		}
+		log.Info("msg %s SCHEDULED after %s", msg.String(), sendAfter.Format(time.RFC3339))
+	}
+
+	if err := AddTraceHeaders(env.Body, peer, queueId, server.Profile.Name); err != nil {
+		log.Error("message %s can't add trace headers, DROPPED: %s", msg.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return ErrMessageError
+	}
+
+	priority, err := TakePriority(&msg, env.Body, server.Profile.Priority)
+	if err != nil {
+		log.Error("message %s can't remove %s, DROPPED: %s", msg.String(), PRIORITY_HEADER, err.Error())
+		MailDroppedIncreaseCounter(1)
+		return ErrMessageError
+	}
+
+	campaign, err := TakeCampaignId(&msg, env.Body)
+	if err != nil {
+		log.Error("message %s can't remove %s, DROPPED: %s", msg.String(), CAMPAIGN_HEADER, err.Error())
+		MailDroppedIncreaseCounter(1)
+		return ErrMessageError
+	}
+
+	signature := &DKIMSignature{}
 	for domain, _ := range msg.RcptDomains {
 
 		mailServer, err := lookupMailServer(strings.ToLower(domain), 0)
@@ -137,35 +235,134 @@ func smtpHandler(peer smtpd.Peer, env smtpd.Envelope) error {
 		}
 
 		entries = append(entries, QueueEntry{MailServer: mailServer,
+			Id:              SubQueueId(queueId, len(entries)+1),
+			QueueId:         queueId,
 			Sender:          env.Sender,
 			Recipients:      msg.GetDomainRecipientList(domain),
-			Data:            env.Data,
+			Body:            env.Body,
+			Signature:       signature,
+			BodyType:        env.BodyType,
+			SMTPUTF8:        msg.NeedsSMTPUTF8(),
+			Ret:             env.Ret,
+			EnvID:           env.EnvID,
+			DSN:             EnvelopeDSN(env.DSN, msg.GetDomainRecipientList(domain)),
+			Priority:        priority,
+			SendAfter:       sendAfter,
+			UnqueueTime:     sendAfter,
+			CampaignId:      campaign,
 			SenderDomain:    msg.Sender.Domain,
 			RecipientDomain: domain,
-			MessageId:       msg.MessageId})
+			MessageId:       msg.MessageId,
+			AuthUser:        peer.Username})
 	}
 	for _, entry := range entries {
+		entry.Body.Retain()
+		Campaigns.Record(entry.CampaignId, entry.Id, CAMPAIGN_RESULT_RECEIVED)
 		PushMail(entry)
 	}
 	return nil
 
 }
 
-func StartSMTPServer() {
+func (server *StoppableSMTPServer) smtpConnectionChecker(peer smtpd.Peer) error {
+	InboundSessionsCounter.With(server.Profile.Name).Inc()
+	if err := CheckClientAccess(LISTENER_SMTP, peer.Addr); err != nil {
+		log.Warn("SMTP connection from %s rejected: %s", peer.Addr.String(), err.Error())
+		return err
+	}
+	if IntakeThrottled() {
+		log.Warn("SMTP connection from %s rejected: %s", peer.Addr.String(), ErrQueueFullSession.Error())
+		return ErrQueueFullSession
+	}
+	return nil
+}
 
-	smtpServer.Hostname = conf.ServerHostName
-	smtpServer.WelcomeMessage = conf.WelcomeMessage
-	smtpServer.MaxConnections = conf.MaxIncomingConnections
-	smtpServer.Handler = handlerPanicProcessor(smtpHandler)
+// SMTPListenerProfiles returns the configured listener profiles, or a single
+// profile on ListenPort built from the global settings if there are none
+func SMTPListenerProfiles(tlsConfigured bool) []ListenerConf {
+	if len(conf.Listeners) > 0 {
+		return conf.Listeners
+	}
+	profile := ListenerConf{Name: LISTENER_SMTP, Address: conf.ListenPort, Mode: LISTENER_MODE_PLAIN}
+	if tlsConfigured {
+		profile.Mode = LISTENER_MODE_STARTTLS
+	}
+	profile.RequireAuth = GetAuthenticator() != nil
+	return []ListenerConf{profile}
+}
 
-	log.Info("SYSTEM: SMTP Relay started at %s", conf.ListenPort)
+func NewSMTPServer(profile ListenerConf, tlsConfig *tls.Config) (*StoppableSMTPServer, error) {
+	if profile.Name == "" {
+		profile.Name = profile.Address
+	}
+	if profile.WelcomeMessage == "" {
+		profile.WelcomeMessage = conf.WelcomeMessage
+	}
+	if profile.MaxRecipients == 0 {
+		profile.MaxRecipients = conf.MaxRecipients
+	}
+	if profile.MaxMessageSize == 0 {
+		profile.MaxMessageSize = conf.MaxMessageSize
+	}
+	if _, err := ParsePriority(profile.Priority); err != nil {
+		return nil, fmt.Errorf("listener %s: %s", profile.Name, err.Error())
+	}
+	server := &StoppableSMTPServer{Profile: profile}
+	server.Hostname = conf.ServerHostName
+	server.WelcomeMessage = profile.WelcomeMessage
+	server.MaxConnections = conf.MaxIncomingConnections
+	server.MaxMessageSize = profile.MaxMessageSize
+	server.MaxRecipients = profile.MaxRecipients
+	server.SpoolDir = conf.SpoolDir
+	server.SpoolThreshold = conf.SpoolThreshold
+	server.Handler = handlerPanicProcessor(server.smtpHandler)
+	server.QueueID = NewQueueId
+	server.ConnectionChecker = server.smtpConnectionChecker
+	server.ProxyProtocolChecker = IsTrustedProxy
+	if err := ConfigureSMTPSecurity(&server.Server, profile, tlsConfig); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
 
-	err := smtpServer.Start()
+func StartSMTPServer() {
+	tlsConfig, err := LoadTLSConfig()
+	if err != nil {
+		log.Critical("can't load TLS certificate:%s", err.Error())
+		panic(err.Error())
+	}
+	a, err := LoadAuthenticator()
 	if err != nil {
+		log.Critical("can't load SMTP AUTH backend:%s", err.Error())
 		panic(err.Error())
 	}
+	SetAuthenticator(a)
+
+	for _, profile := range SMTPListenerProfiles(tlsConfig != nil) {
+		server, err := NewSMTPServer(profile, tlsConfig)
+		if err != nil {
+			log.Critical("can't configure SMTP listener:%s", err.Error())
+			panic(err.Error())
+		}
+		if err := server.Start(); err != nil {
+			log.Critical("can't start SMTP listener %s at %s:%s", server.Profile.Name, server.Profile.Address, err.Error())
+			panic(err.Error())
+		}
+		smtpServers = append(smtpServers, server)
+		log.Info("SYSTEM: SMTP Relay listener %s started at %s (mode: %s, auth required: %t)",
+			server.Profile.Name, server.Profile.Address, server.Profile.Mode, server.Profile.RequireAuth)
+	}
 }
 
+// StopSMTPServer stops all listeners at once and waits for their sessions
 func StopSMTPServer() {
-	smtpServer.Stop()
+	var wg sync.WaitGroup
+	for _, server := range smtpServers {
+		wg.Add(1)
+		go func(server *StoppableSMTPServer) {
+			defer wg.Done()
+			server.Stop()
+		}(server)
+	}
+	wg.Wait()
 }
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"runtime"
 	"smtprelay/smtpd"
+	"smtprelay/spool"
 	"syscall"
 	"time"
 )
@@ -32,9 +33,23 @@ func ReloadConfig(filename string) {
 	newConf := new(Conf)
 	if err := newConf.Load(flags.MainConfigFilePath); err != nil {
 		log.Critical("can't reload config, old settings will be used:", err.Error())
+		return
 	}
 	conf = newConf
 	runtime.GOMAXPROCS(conf.NumCPU)
+	ReloadAuthenticator()
+	if err := LoadACLs(); err != nil {
+		log.Critical("can't reload network ACLs, old settings will be used:%s", err.Error())
+	}
+	if err := LoadSenderPolicy(); err != nil {
+		log.Critical("can't reload sender domain policy, old settings will be used:%s", err.Error())
+	}
+	if err := LoadHeaderRules(); err != nil {
+		log.Critical("can't reload header rules, old settings will be used:%s", err.Error())
+	}
+	if err := LoadRateLimits(); err != nil {
+		log.Critical("can't reload rate limits, old settings will be used:%s", err.Error())
+	}
 }
 
 func main() {
@@ -52,6 +67,38 @@ func main() {
 
 	runtime.GOMAXPROCS(conf.NumCPU)
 
+	if err := LoadACLs(); err != nil {
+		log.Critical("can't load network ACLs:%s", err.Error())
+		panic(err.Error())
+	}
+
+	if err := LoadSenderPolicy(); err != nil {
+		log.Critical("can't load sender domain policy:%s", err.Error())
+		panic(err.Error())
+	}
+
+	if err := LoadHeaderRules(); err != nil {
+		log.Critical("can't load header rules:%s", err.Error())
+		panic(err.Error())
+	}
+
+	if err := LoadRateLimits(); err != nil {
+		log.Critical("can't load rate limits:%s", err.Error())
+		panic(err.Error())
+	}
+
+	if conf.SpoolDir != "" {
+		if err := os.MkdirAll(conf.SpoolDir, 0700); err != nil {
+			log.Critical("can't create spool dir %s:%s", conf.SpoolDir, err.Error())
+			panic(err.Error())
+		}
+		if count, err := spool.Clean(conf.SpoolDir); err != nil {
+			log.Error("can't clean spool dir %s:%s", conf.SpoolDir, err.Error())
+		} else if count > 0 {
+			log.Warn("SYSTEM: Removed %d stale spool files from %s", count, conf.SpoolDir)
+		}
+	}
+
 	if err := InitQueues(); err != nil {
 		log.Critical("can't init MQ", err.Error())
 		panic(err.Error())
@@ -59,6 +106,7 @@ func main() {
 
 	log.Info("SYSTEM: MQ initialized")
 	go StartStatisticServer()
+	go StartAdminServer()
 	go StartSender()
 
 	if conf.DKIMEnabled {
@@ -68,6 +116,7 @@ func main() {
 			log.Critical("Can't load DKIM repo:%s", err.Error())
 			panic(err.Error())
 		}
+		SetDKIMKeysLoaded(len(DKIMRepo))
 	} else {
 		log.Info("DKIM disabled")
 	}
@@ -139,13 +188,33 @@ func StartSignalListener() {
 }
 
 func GracefullyStop() {
+	SetShuttingDown()
 	StopSMTPServer()
 	StopTCPListener()
-	log.Info("SYSTEM: Waiting for processing existing outcoming SMTP connections and queued messages (%d in all queues)", GetMailQueueLength()+GetErrorQueueLength())
-	for GetMailQueueLength()+GetErrorQueueLength() > 0 {
-		FlushErrors()
-		time.Sleep(1 * time.Second)
-		log.Info("SYSTEM: Messages left in queues - %d (mails - %d;errors - %d)", GetMailQueueLength()+GetErrorQueueLength(), GetMailQueueLength(), GetErrorQueueLength())
+	log.Info("SYSTEM: Waiting for processing existing outcoming SMTP connections and queued messages (%d in all queues)", GetQueuedLength())
+	for {
+		for MailQueue.Deliverable()+ErrorQueue.Deliverable() > 0 {
+			FlushErrors()
+			time.Sleep(1 * time.Second)
+			log.Info("SYSTEM: Messages left in queues - %d (mails - %d;errors - %d)", GetMailQueueLength()+GetErrorQueueLength(), GetMailQueueLength(), GetErrorQueueLength())
+		}
+		// Queues live in memory only, so held and scheduled mail is never
+		// dropped on exit
+		if held := GetDeliveryQueueLength(); held > 0 {
+			if conf.ShutdownHeldMail == SHUTDOWN_HELD_RELEASE {
+				log.Warn("SYSTEM: Releasing %d held messages for delivery before stopping", held)
+				Holds.ReleaseAll()
+				HoldMail(QueueFilter{}, false)
+				continue
+			}
+			log.Warn("SYSTEM: %d held messages left, release or delete them through the admin API to finish stopping", held)
+		} else if scheduled := GetScheduledQueueLength(); scheduled > 0 {
+			// Scheduled mail isn't sent before its time, even on shutdown
+			log.Warn("SYSTEM: %d scheduled messages left, waiting until they are due; send them now or delete them through the admin API to finish stopping", scheduled)
+		} else {
+			break
+		}
+		time.Sleep(SHUTDOWN_HELD_WAIT_INTERVAL)
 	}
 	time.Sleep(200 * time.Millisecond)
 	log.Info("SYSTEM: Smtprelay stopped")
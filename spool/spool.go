@@ -0,0 +1,241 @@
+// Package spool holds message bodies in memory or, once they grow past a
+// threshold, in a spool file, so large messages can be streamed instead of
+// buffered.
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const (
+	DefaultThreshold = 1 << 20
+	FilePrefix       = "smtprelay-"
+)
+
+var ErrNoBody = errors.New("no message body")
+
+// Body is a message body shared by the queue entries of one message. It
+// starts with one reference; the spool file is removed when the last
+// reference is released.
+type Body struct {
+	data   []byte
+	prefix []byte // Put in front of the spool file
+	skip   int64  // Bytes at the start of the spool file left out
+	path   string
+	size   int64
+	refs   int32
+}
+
+// NewBody wraps data already held in memory
+func NewBody(data []byte) *Body {
+	return &Body{data: data, size: int64(len(data)), refs: 1}
+}
+
+func (b *Body) Len() int64 {
+	return b.size
+}
+
+func (b *Body) InMemory() bool {
+	return b.path == ""
+}
+
+// Path returns the spool file name, empty for in-memory bodies
+func (b *Body) Path() string {
+	return b.path
+}
+
+// Open returns a reader positioned at the start of the body. Every reader
+// is independent, so several deliveries can stream the same body at once.
+func (b *Body) Open() (io.ReadCloser, error) {
+	if b == nil {
+		return nil, ErrNoBody
+	}
+	if b.InMemory() {
+		return ioutil.NopCloser(bytes.NewReader(b.data)), nil
+	}
+	file, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	if b.skip > 0 {
+		if _, err := file.Seek(b.skip, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if len(b.prefix) == 0 {
+		return file, nil
+	}
+	return prefixedFile{io.MultiReader(bytes.NewReader(b.prefix), file), file}, nil
+}
+
+type prefixedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// Bytes returns the whole body, reading the spool file if there is one
+func (b *Body) Bytes() ([]byte, error) {
+	if b == nil {
+		return nil, ErrNoBody
+	}
+	if b.InMemory() {
+		return b.data, nil
+	}
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, b.prefix...), data[b.skip:]...), nil
+}
+
+// Prepend puts data in front of the body, e.g. to add a header. It must
+// not be called once the body is shared.
+func (b *Body) Prepend(data []byte) {
+	b.Replace(0, data)
+}
+
+// Replace replaces the first n bytes of the body with data, e.g. to rewrite
+// the header. Like Prepend it must not be called once the body is shared.
+func (b *Body) Replace(n int64, data []byte) {
+	if n > b.size {
+		n = b.size
+	}
+	if b.InMemory() {
+		b.data = append(append([]byte{}, data...), b.data[n:]...)
+	} else if n <= int64(len(b.prefix)) {
+		b.prefix = append(append([]byte{}, data...), b.prefix[n:]...)
+	} else {
+		b.skip += n - int64(len(b.prefix))
+		b.prefix = append([]byte{}, data...)
+	}
+	b.size += int64(len(data)) - n
+}
+
+func (b *Body) Retain() *Body {
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// Release drops a reference and removes the spool file with the last one
+func (b *Body) Release() error {
+	if b == nil || atomic.AddInt32(&b.refs, -1) > 0 {
+		return nil
+	}
+	if b.InMemory() {
+		b.data = nil
+		return nil
+	}
+	return os.Remove(b.path)
+}
+
+// Writer collects a body in memory and moves it to a file in Dir as soon
+// as it exceeds Threshold bytes
+type Writer struct {
+	Dir       string
+	Threshold int64
+
+	buf    bytes.Buffer
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	err    error
+}
+
+func NewWriter(dir string, threshold int64) *Writer {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	return &Writer{Dir: dir, Threshold: threshold}
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.file == nil && w.size+int64(len(p)) > w.Threshold {
+		if w.err = w.spill(); w.err != nil {
+			return 0, w.err
+		}
+	}
+	if w.file == nil {
+		n, _ = w.buf.Write(p)
+	} else {
+		n, w.err = w.writer.Write(p)
+	}
+	w.size += int64(n)
+	return n, w.err
+}
+
+func (w *Writer) spill() (err error) {
+	if w.file, err = ioutil.TempFile(w.Dir, FilePrefix); err != nil {
+		return err
+	}
+	w.writer = bufio.NewWriter(w.file)
+	_, err = w.writer.Write(w.buf.Bytes())
+	w.buf = bytes.Buffer{}
+	return err
+}
+
+// Len returns the number of bytes written so far
+func (w *Writer) Len() int64 {
+	return w.size
+}
+
+// Err returns the first error writing the spool file
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// Body finishes writing and returns the collected body
+func (w *Writer) Body() (*Body, error) {
+	if w.err != nil {
+		w.Discard()
+		return nil, w.err
+	}
+	if w.file == nil {
+		return NewBody(w.buf.Bytes()), nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		w.Discard()
+		return nil, err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return nil, err
+	}
+	return &Body{path: w.file.Name(), size: w.size, refs: 1}, nil
+}
+
+// Discard drops whatever was written, removing the spool file
+func (w *Writer) Discard() {
+	w.buf = bytes.Buffer{}
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		w.file = nil
+	}
+}
+
+// Clean removes spool files left in dir by a previous run. The queue lives
+// in memory, so nothing references them any more.
+func Clean(dir string) (count int, err error) {
+	files, err := filepath.Glob(filepath.Join(dir, FilePrefix+"*"))
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if err = os.Remove(file); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,157 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriterInMemory(t *testing.T) {
+	w := NewWriter(os.TempDir(), 16)
+	w.Write([]byte("short body"))
+	body, err := w.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !body.InMemory() {
+		t.Errorf("expect body in memory, got - file '%s'", body.Path())
+	}
+	data, _ := body.Bytes()
+	if string(data) != "short body" {
+		t.Errorf("expect 'short body', got - '%s'", data)
+	}
+}
+
+func TestWriterSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewWriter(dir, 16)
+	w.Write([]byte("first line\r\n"))
+	w.Write([]byte("second line\r\n"))
+	body, err := w.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.InMemory() {
+		t.Fatal("expect body spilled to file")
+	}
+	if body.Len() != 25 {
+		t.Errorf("expect length 25, got - %d", body.Len())
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "first line\r\nsecond line\r\n" {
+		t.Errorf("expect both lines, got - '%s'", data)
+	}
+
+	body.Retain()
+	body.Release()
+	if _, err := os.Stat(body.Path()); err != nil {
+		t.Errorf("expect spool file kept while referenced, got - %s", err)
+	}
+	body.Release()
+	if _, err := os.Stat(body.Path()); !os.IsNotExist(err) {
+		t.Errorf("expect spool file removed, got - %v", err)
+	}
+}
+
+func TestWriterDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewWriter(dir, 4)
+	w.Write([]byte("too long for memory"))
+	w.Discard()
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("expect spool dir empty, got - %d files", len(files))
+	}
+}
+
+func TestBodyPrepend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, threshold := range []int64{64, 4} {
+		w := NewWriter(dir, threshold)
+		w.Write([]byte("Subject: test\r\n"))
+		body, err := w.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Prepend([]byte("X-Second: 2\r\n"))
+		body.Prepend([]byte("X-First: 1\r\n"))
+
+		expect := "X-First: 1\r\nX-Second: 2\r\nSubject: test\r\n"
+		if body.Len() != int64(len(expect)) {
+			t.Errorf("expect length %d, got - %d", len(expect), body.Len())
+		}
+		data, _ := body.Bytes()
+		if string(data) != expect {
+			t.Errorf("expect '%s', got - '%s'", expect, data)
+		}
+		r, err := body.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ = ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != expect {
+			t.Errorf("expect '%s', got - '%s'", expect, data)
+		}
+		body.Release()
+	}
+}
+
+func TestBodyReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, threshold := range []int64{64, 4} {
+		w := NewWriter(dir, threshold)
+		w.Write([]byte("Subject: test\r\n\r\nbody\r\n"))
+		body, err := w.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Prepend([]byte("X-First: 1\r\n"))
+		body.Replace(int64(len("X-First: 1\r\nSubject: test\r\n")), []byte("Subject: new\r\n"))
+
+		expect := "Subject: new\r\n\r\nbody\r\n"
+		if body.Len() != int64(len(expect)) {
+			t.Errorf("expect length %d, got - %d", len(expect), body.Len())
+		}
+		data, _ := body.Bytes()
+		if string(data) != expect {
+			t.Errorf("expect '%s', got - '%s'", expect, data)
+		}
+		r, err := body.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ = ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != expect {
+			t.Errorf("expect '%s', got - '%s'", expect, data)
+		}
+		body.Release()
+	}
+}
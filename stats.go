@@ -3,101 +3,150 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 )
 
 func GetErrorQueueLength() int64 {
-	return int64(len(ErrorChannel))
+	return int64(ErrorQueue.Len())
 }
 
 func GetMailQueueLength() int64 {
-	return int64(len(MailChannel))
+	return int64(MailQueue.Len())
 }
 
-const (
-	STATISTICS_CHANNELS_SIZE = 100000
-)
+func GetScheduledQueueLength() int64 {
+	return int64(ScheduledQueue.Len())
+}
 
+// GetDeliveryQueueLength returns the number of entries waiting for delivery,
+// those in the mail and error queues
+func GetDeliveryQueueLength() int64 {
+	return GetMailQueueLength() + GetErrorQueueLength()
+}
+
+// GetQueuedLength returns the number of entries in all queues
+func GetQueuedLength() int64 {
+	return GetMailQueueLength() + GetErrorQueueLength() + GetScheduledQueueLength()
+}
+
+// Counters are updated with sync/atomic from any goroutine and read the same
+// way by the HTTP handlers.
 var (
 	MailSendersCounter  int64
 	MailHandlersCounter int64
 	MaxQueueCounter     int64
 	MailSentCounter     int64
 	MailDroppedCounter  int64
-	MailSentChannel     chan int
-	MailDroppedChannel  chan int
-	MailMaxQueueChannel chan int
-	MailHandlersChannel chan int
-	MailSendersChannel  chan int
-)
-
-func InitStatistics() {
-	MailSentChannel = make(chan int)
-	MailDroppedChannel = make(chan int, STATISTICS_CHANNELS_SIZE)
-	MailMaxQueueChannel = make(chan int, STATISTICS_CHANNELS_SIZE)
-	MailHandlersChannel = make(chan int, STATISTICS_CHANNELS_SIZE)
-	MailSendersChannel = make(chan int, STATISTICS_CHANNELS_SIZE)
-
-	go func() {
-		for val := range MailSentChannel {
-			MailSentCounter += int64(val)
-		}
-	}()
-
-	go func() {
-		for val := range MailDroppedChannel {
-			MailDroppedCounter += int64(val)
-		}
-	}()
-
-	go func() {
-		for val := range MailMaxQueueChannel {
-			if int64(val) > MaxQueueCounter {
-				MaxQueueCounter = int64(val)
-			}
-
-		}
-	}()
-
-	go func() {
-		for val := range MailHandlersChannel {
-			MailHandlersCounter += int64(val)
-		}
-	}()
+	MailDeferredCounter int64
+	MailReceivedCounter int64
 
-	go func() {
-		for val := range MailSendersChannel {
-			MailSendersCounter += int64(val)
-		}
-	}()
-}
+	MailSentRate     = NewRateCounter()
+	MailDroppedRate  = NewRateCounter()
+	MailDeferredRate = NewRateCounter()
+	MailReceivedRate = NewRateCounter()
+)
 
+// QueueStats is the JSON statistics page. It is kept for compatibility with
+// existing dashboards; the fields marked deprecated are exported by /metrics
+// and will be dropped from here.
 type QueueStats struct {
 	OverallCounter               int64
-	ErrorBufferCounter           int64
-	MailBufferCounter            int64
-	OutboundSMTPConnects         int64
+	ErrorBufferCounter           int64 // Deprecated: smtprelay_deferred_queue_depth
+	MailBufferCounter            int64 // Deprecated: smtprelay_mail_queue_depth
+	ScheduledBufferCounter       int64 // Deprecated: smtprelay_scheduled_queue_depth
+	OutboundSMTPConnects         int64 // Deprecated: smtprelay_outbound_connections
 	InboundTCPHandlers           int64
 	InboundTCPConnects           int64
 	InboundSMTPConnects          int64
 	MaxQueueSizeSinceLastRestart int64
-	MailSentSinceLastRestart     int64
-	MailDroppedSinceLastRestart  int64
-	Configuration                *Conf
+	MailSentSinceLastRestart     int64 // Deprecated: smtprelay_deliveries_total{result="sent"}
+	MailDroppedSinceLastRestart  int64 // Deprecated: smtprelay_deliveries_total{result="dropped"}
+	MailDeferredSinceLastRestart int64 // Deprecated: smtprelay_deliveries_total{result="deferred"}
+	MailReceivedSinceLastRestart int64
+	SentRates                    Rates
+	DroppedRates                 Rates
+	DeferredRates                Rates
+	ReceivedRates                Rates
+	IntakeThrottled              bool // Deprecated: smtprelay_intake_throttled
+	DeliveryHolds                DeliveryHoldsState
+	Configuration                StatsConfiguration
+}
+
+// StatsConfiguration is the part of Conf shown on the statistics page,
+// which is served without authentication: no credentials, networks or
+// sender policies.
+type StatsConfiguration struct {
+	ServerHostName          string
+	ListenPort              string
+	WelcomeMessage          string
+	MaxIncomingConnections  int
+	MaxOutcomingConnections int
+	DKIMEnabled             bool
+	DKIMKeyDir              string
+	RelayModeEnabled        bool
+	RelayServer             string
+	NumCPU                  int
+	StatisticPort           string
+	DeferredMailDelay       int
+	DeferredMailMaxErrors   int
+	MaxRecipients           int
+	MaxMessageSize          int
+	ListenTCPPort           string
+	TCPMaxConnections       int
+	TCPMaxHandlers          int
+	TCPTimeoutSeconds       int
+	QueueHighWatermark      int
+	QueueLowWatermark       int
+}
+
+func GetStatsConfiguration(c *Conf) StatsConfiguration {
+	return StatsConfiguration{
+		ServerHostName:          c.ServerHostName,
+		ListenPort:              c.ListenPort,
+		WelcomeMessage:          c.WelcomeMessage,
+		MaxIncomingConnections:  c.MaxIncomingConnections,
+		MaxOutcomingConnections: c.MaxOutcomingConnections,
+		DKIMEnabled:             c.DKIMEnabled,
+		DKIMKeyDir:              c.DKIMKeyDir,
+		RelayModeEnabled:        c.RelayModeEnabled,
+		RelayServer:             c.RelayServer,
+		NumCPU:                  c.NumCPU,
+		StatisticPort:           c.StatisticPort,
+		DeferredMailDelay:       c.DeferredMailDelay,
+		DeferredMailMaxErrors:   c.DeferredMailMaxErrors,
+		MaxRecipients:           c.MaxRecipients,
+		MaxMessageSize:          c.MaxMessageSize,
+		ListenTCPPort:           c.ListenTCPPort,
+		TCPMaxConnections:       c.TCPMaxConnections,
+		TCPMaxHandlers:          c.TCPMaxHandlers,
+		TCPTimeoutSeconds:       c.TCPTimeoutSeconds,
+		QueueHighWatermark:      c.QueueHighWatermark,
+		QueueLowWatermark:       c.QueueLowWatermark,
+	}
 }
 
 func GetStatistics() (data []byte, err error) {
 	var stats QueueStats
-	stats.OutboundSMTPConnects = MailSendersCounter
-	stats.InboundSMTPConnects = MailHandlersCounter
-	stats.ErrorBufferCounter = int64(len(ErrorChannel))
-	stats.MailBufferCounter = int64(len(MailChannel))
+	stats.OutboundSMTPConnects = atomic.LoadInt64(&MailSendersCounter)
+	stats.InboundSMTPConnects = atomic.LoadInt64(&MailHandlersCounter)
+	stats.ErrorBufferCounter = GetErrorQueueLength()
+	stats.MailBufferCounter = GetMailQueueLength()
+	stats.ScheduledBufferCounter = GetScheduledQueueLength()
 	stats.InboundTCPHandlers = int64(len(TCPHandlersLimiter))
 	stats.InboundTCPConnects = int64(len(TCPConnectionsLimiter))
-	stats.OverallCounter = stats.ErrorBufferCounter + stats.MailBufferCounter
-	stats.MaxQueueSizeSinceLastRestart = MaxQueueCounter
-	stats.MailSentSinceLastRestart = MailSentCounter
-	stats.MailDroppedSinceLastRestart = MailDroppedCounter
-	stats.Configuration = conf
+	stats.OverallCounter = stats.ErrorBufferCounter + stats.MailBufferCounter + stats.ScheduledBufferCounter
+	stats.MaxQueueSizeSinceLastRestart = atomic.LoadInt64(&MaxQueueCounter)
+	stats.MailSentSinceLastRestart = atomic.LoadInt64(&MailSentCounter)
+	stats.MailDroppedSinceLastRestart = atomic.LoadInt64(&MailDroppedCounter)
+	stats.MailDeferredSinceLastRestart = atomic.LoadInt64(&MailDeferredCounter)
+	stats.MailReceivedSinceLastRestart = atomic.LoadInt64(&MailReceivedCounter)
+	stats.SentRates = MailSentRate.Rates()
+	stats.DroppedRates = MailDroppedRate.Rates()
+	stats.DeferredRates = MailDeferredRate.Rates()
+	stats.ReceivedRates = MailReceivedRate.Rates()
+	stats.IntakeThrottled = IntakeThrottled()
+	stats.DeliveryHolds = Holds.State()
+	stats.Configuration = GetStatsConfiguration(conf)
 	data, err = json.Marshal(stats)
 	if err != nil {
 		return data, err
@@ -106,31 +155,49 @@ func GetStatistics() (data []byte, err error) {
 }
 
 func MailSentIncreaseCounter(count int) {
-	MailSentChannel <- count
+	atomic.AddInt64(&MailSentCounter, int64(count))
+	MailSentRate.Add(int64(count))
 }
 
 func MailDroppedIncreaseCounter(count int) {
-	MailDroppedChannel <- count
+	atomic.AddInt64(&MailDroppedCounter, int64(count))
+	MailDroppedRate.Add(int64(count))
+}
+
+func MailDeferredIncreaseCounter(count int) {
+	atomic.AddInt64(&MailDeferredCounter, int64(count))
+	MailDeferredRate.Add(int64(count))
+}
+
+func MailReceivedIncreaseCounter(count int) {
+	atomic.AddInt64(&MailReceivedCounter, int64(count))
+	MailReceivedRate.Add(int64(count))
 }
 
 func MailQueueCheckMax() {
-	MailMaxQueueChannel <- int(GetErrorQueueLength() + GetMailQueueLength())
+	size := GetQueuedLength()
+	for {
+		max := atomic.LoadInt64(&MaxQueueCounter)
+		if size <= max || atomic.CompareAndSwapInt64(&MaxQueueCounter, max, size) {
+			return
+		}
+	}
 }
 
 func MailSendersIncreaseCounter(count int) {
-	MailSendersChannel <- count
+	atomic.AddInt64(&MailSendersCounter, int64(count))
 }
 
 func MailSendersDecreaseCounter(count int) {
-	MailSendersChannel <- -count
+	atomic.AddInt64(&MailSendersCounter, -int64(count))
 }
 
 func MailHandlersIncreaseCounter(count int) {
-	MailHandlersChannel <- count
+	atomic.AddInt64(&MailHandlersCounter, int64(count))
 }
 
 func MailHandlersDecreaseCounter(count int) {
-	MailHandlersChannel <- -count
+	atomic.AddInt64(&MailHandlersCounter, -int64(count))
 }
 
 func StatisticHandler(w http.ResponseWriter, r *http.Request) {
@@ -143,7 +210,15 @@ func StatisticHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func StartStatisticServer() {
-	InitStatistics()
 	http.HandleFunc("/", StatisticHandler)
-	http.ListenAndServe(":"+conf.StatisticPort, nil)
+	http.HandleFunc("/metrics", Metrics.Handler())
+	http.HandleFunc("/healthz", HealthHandler)
+	http.HandleFunc("/readyz", ReadyHandler)
+	for _, path := range adminPaths {
+		http.HandleFunc(path, http.NotFound)
+	}
+	log.Info("SYSTEM: Statistic server started at port %s", conf.StatisticPort)
+	if err := http.ListenAndServe(":"+conf.StatisticPort, nil); err != nil {
+		log.Critical("can't start statistic server at port %s:%s", conf.StatisticPort, err.Error())
+	}
 }
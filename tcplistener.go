@@ -10,6 +10,8 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"smtprelay/smtpd"
+	"smtprelay/spool"
 	"strings"
 	"time"
 )
@@ -26,6 +28,11 @@ var (
 
 func StartTCPServer() {
 
+	if _, err := ParsePriority(conf.TCPPriority); err != nil {
+		log.Critical("can't start TCP listener: TCPPriority: %s", err.Error())
+		panic(err.Error())
+	}
+
 	l, err := net.Listen("tcp", conf.ListenTCPPort)
 	if err != nil {
 		log.Critical("can't start TCP listener:%s", err.Error())
@@ -35,6 +42,8 @@ func StartTCPServer() {
 	TCPHandlersLimiter = make(chan int, conf.TCPMaxHandlers)
 	TCPConnectionsLimiter = make(chan int, conf.TCPMaxConnections)
 	TCPListenerStarted = true
+	SetTCPListenerUp(true)
+	defer SetTCPListenerUp(false)
 	log.Info("SYSTEM: Started TCP listener at  " + conf.ListenTCPPort)
 	for TCPListenerStarted {
 		conn, err := l.Accept()
@@ -43,6 +52,16 @@ func StartTCPServer() {
 			continue
 		}
 		log.Debug("connection accepted from %s", conn.RemoteAddr().String())
+		InboundSessionsCounter.With(LISTENER_TCP).Inc()
+		// Connections through a trusted proxy are checked once the handler
+		// has read the client address from the PROXY header
+		if !IsTrustedProxy(conn.RemoteAddr()) {
+			if err := CheckNetworkAccess(LISTENER_TCP, conn.RemoteAddr()); err != nil {
+				log.Warn("TCP connection from %s rejected: %s", conn.RemoteAddr().String(), err.Error())
+				conn.Close()
+				continue
+			}
+		}
 		TCPConnectionsLimiter <- 0
 		go tcpHandler(conn)
 	}
@@ -52,6 +71,7 @@ func StartTCPServer() {
 func StopTCPListener() {
 	log.Info("SYSTEM: Stopping TCP listener")
 	TCPListenerStarted = false
+	SetTCPListenerUp(false)
 	if len(TCPHandlersLimiter) > 0 {
 		log.Info("Waiting for processing existing %d tcp connections", len(TCPHandlersLimiter))
 		for len(TCPHandlersLimiter) > 0 {
@@ -70,9 +90,22 @@ func writeErrorResponse(conn net.Conn, arg0 string, args ...interface{}) {
 	<-TCPConnectionsLimiter
 }
 
-func writeSuccessResponse(conn net.Conn) {
+// writeRetryResponse answers RETRY and the reason, telling the client to
+// send the packet again later
+func writeRetryResponse(conn net.Conn, arg0 string, args ...interface{}) {
+	log.Warn(arg0, args...)
+	conn.Write([]byte("RETRY " + fmt.Sprintf(arg0, args...)))
+	if err := conn.Close(); err != nil {
+		log.Error("error close connection (retry response): %s", err.Error())
+	}
+	<-TCPConnectionsLimiter
+}
+
+// writeSuccessResponse answers OK followed by the queue IDs of the messages
+// in the packet, in packet order
+func writeSuccessResponse(conn net.Conn, queueIds []string) {
 	log.Debug("success response to %s", conn.RemoteAddr().String())
-	conn.Write([]byte("OK"))
+	conn.Write([]byte(strings.Join(append([]string{"OK"}, queueIds...), " ")))
 	if err := conn.Close(); err != nil {
 		log.Error("error close connection (success response): %s", err.Error())
 	}
@@ -85,9 +118,33 @@ func closeNoResponse(conn net.Conn) {
 	<-TCPConnectionsLimiter
 }
 
+// proxiedConn is a connection accepted from a trusted proxy. RemoteAddr
+// reports the client address from the PROXY header, and reads go through
+// the reader that parsed it.
+type proxiedConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.remoteAddr }
+
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	addr, err := smtpd.ReadProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, remoteAddr: addr}, nil
+}
+
 func readMetaData(conn net.Conn) (payloadSize int64, err error) {
 	metadata := make([]byte, METADATA_LENGTH_BYTES)
-	_, err = conn.Read(metadata)
+	_, err = io.ReadFull(conn, metadata)
 	if err != nil {
 		return
 	}
@@ -144,6 +201,26 @@ func tcpHandler(conn net.Conn) {
 		<-TCPHandlersLimiter
 	}()
 
+	if IsTrustedProxy(conn.RemoteAddr()) {
+		proxyAddr := conn.RemoteAddr().String()
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			writeErrorResponse(conn, "error reading PROXY header from %s: %s", proxyAddr, err.Error())
+			return
+		}
+		conn = proxied
+		log.Debug("connection from %s proxied by %s", conn.RemoteAddr().String(), proxyAddr)
+		if err := CheckNetworkAccess(LISTENER_TCP, conn.RemoteAddr()); err != nil {
+			writeErrorResponse(conn, "TCP connection from %s rejected: %s", conn.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+
+	if err := CheckDNSBL(conn.RemoteAddr()); err != nil {
+		writeErrorResponse(conn, "TCP connection from %s rejected: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
 	payloadSize, err := readMetaData(conn)
 	if err != nil {
 		if err == io.EOF {
@@ -172,70 +249,204 @@ func tcpHandler(conn net.Conn) {
 	//		return
 	//	}
 
-	writeSuccessResponse(conn)
+	if IntakeThrottled() {
+		writeRetryResponse(conn, "packet from %s refused, queue is full", conn.RemoteAddr().String())
+		return
+	}
 
 	log.Debug("unmarshalling payload from %s", conn.RemoteAddr().String())
 
 	packet := &EmailMessageWithByteArrayPacket{}
 	err = proto.Unmarshal(payload, packet)
 	if err != nil {
-		log.Error("error deserializing email packet from %s: %s", conn.RemoteAddr().String(), err.Error())
+		writeErrorResponse(conn, "error deserializing email packet from %s: %s", conn.RemoteAddr().String(), err.Error())
 		return
 	}
 
 	log.Debug("Messages deserialized from %s: %d", conn.RemoteAddr().String(), len(packet.GetMessages()))
 
+	var requests []RateLimitRequest
 	for _, email := range packet.Messages {
+		domain, _ := ParseDomain(email.GetSender())
+		requests = append(requests, RateLimitRequest{
+			Client:       AddrIP(conn.RemoteAddr()),
+			SenderDomain: domain,
+			Recipients:   len(email.GetRecipients()),
+		})
+	}
+	if err := CheckRateLimits(requests...); err != nil {
+		writeRetryResponse(conn, "packet from %s refused: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
 
-		var entry QueueEntry
-		entry.Data = email.GetEmlData()
-		entry.Recipients = email.GetRecipients()
-		entry.Sender = email.GetSender()
-
-		msg, err := ParseMessage(entry.Recipients, entry.Sender, entry.Data)
+	queueIds := make([]string, len(packet.Messages))
+	bodies := make([]*spool.Body, len(packet.Messages))
+	entries := make([][]QueueEntry, len(packet.Messages))
+	for i, email := range packet.Messages {
+		queueIds[i] = NewQueueId()
+		bodies[i], entries[i], err = prepareTCPMessage(conn, email, queueIds[i])
 		if err != nil {
-			var rcpt = strings.Join(entry.Recipients, ";")
-			log.Error("msg %s from %s (sender:%s;rcpt:%s) - %s DROPPED: %s", email.GetMessageId(), conn.RemoteAddr().String(), entry.Sender, rcpt, err.Error(), ErrMessageError.Error())
-			MailDroppedIncreaseCounter(1)
-			continue
+			for _, body := range bodies[:i] {
+				body.Release()
+			}
+			if err == ErrScheduledFull {
+				writeRetryResponse(conn, "packet from %s refused, scheduled queue is full", conn.RemoteAddr().String())
+				return
+			}
+			writeErrorResponse(conn, "packet from %s refused, message %d: %s", conn.RemoteAddr().String(), i+1, err.Error())
+			return
+		}
+	}
+	writeSuccessResponse(conn, queueIds)
+
+	for i := range packet.Messages {
+		for _, entry := range entries[i] {
+			entry.Body.Retain()
+			Campaigns.Record(entry.CampaignId, entry.Id, CAMPAIGN_RESULT_RECEIVED)
+			PushMail(entry)
 		}
+		bodies[i].Release()
+	}
 
-		log.Info("msg %s from %s RECEIVED", msg.String(), conn.RemoteAddr().String())
+	return
+}
 
-		if len(entry.Recipients) > conf.MaxRecipients || len(entry.Recipients) == 0 {
-			log.Error("message %s rcpt count limited to %d, DROPPED: %s", msg.String(), conf.MaxRecipients, ErrTooManyRecipients.Error())
-			MailDroppedIncreaseCounter(1)
-			continue
+// prepareTCPMessage checks one message of a TCP packet and splits it by
+// recipient domain into the entries to queue as queueId. This is done for
+// the whole packet before it is answered, so a rejected message fails the
+// packet instead of being dropped after OK. The caller releases body.
+func prepareTCPMessage(conn net.Conn, email *EmailMessageWithByteArray, queueId string) (body *spool.Body, entries []QueueEntry, err error) {
+
+	var entry QueueEntry
+	entry.Body = spool.NewBody(email.GetEmlData())
+	defer func() {
+		if err != nil {
+			entry.Body.Release()
 		}
+	}()
+	entry.Recipients = email.GetRecipients()
+	entry.Sender = email.GetSender()
+
+	msg, err := ParseMessageBody(entry.Recipients, entry.Sender, entry.Body)
+	if err != nil {
+		var rcpt = strings.Join(entry.Recipients, ";")
+		log.Error("msg %s (id:%s) from %s (sender:%s;rcpt:%s) - %s DROPPED: %s", email.GetMessageId(), queueId, conn.RemoteAddr().String(), entry.Sender, rcpt, err.Error(), ErrMessageError.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
+	}
 
-		var entries []QueueEntry
+	msg.QueueId = queueId
+	log.Info("msg %s from %s RECEIVED", msg.String(), conn.RemoteAddr().String())
+	MailReceivedIncreaseCounter(1)
 
-		for domain, _ := range msg.RcptDomains {
+	if len(entry.Recipients) > conf.MaxRecipients || len(entry.Recipients) == 0 {
+		log.Error("message %s rcpt count limited to %d, DROPPED: %s", msg.String(), conf.MaxRecipients, ErrTooManyRecipients.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrTooManyRecipients
+	}
 
-			mailServer, err := lookupMailServer(strings.ToLower(domain), 0)
-			if err != nil {
-				log.Error("message %s can't get MX record for %s - %s, DROPPED: %s", msg.String(), domain, err.Error(), ErrDomainNotFound.Error())
-				MailDroppedIncreaseCounter(1)
-				continue
-			}
+	if err = CheckMessageSender("", conn.RemoteAddr(), &msg); err != nil {
+		log.Error("message %s from %s DROPPED: %s", msg.String(), conn.RemoteAddr().String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, err
+	}
 
-			if conf.RelayModeEnabled {
-				mailServer = conf.RelayServer
-			}
+	headerContext := HeaderContext{
+		Sender:       entry.Sender,
+		SenderDomain: msg.Sender.Domain,
+		MessageId:    msg.MessageId,
+		QueueId:      queueId,
+		Listener:     LISTENER_TCP,
+	}
+	if err = ApplyHeaderRules(entry.Body, headerContext); err != nil {
+		log.Error("message %s header rules failed, DROPPED: %s", msg.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
+	}
+
+	if err = AddMissingHeaders(entry.Body, &msg); err != nil {
+		log.Error("message %s can't add missing headers, DROPPED: %s", msg.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
+	}
 
-			entries = append(entries, QueueEntry{MailServer: mailServer,
-				Sender:          entry.Sender,
-				Recipients:      msg.GetDomainRecipientList(domain),
-				Data:            entry.Data,
-				SenderDomain:    msg.Sender.Domain,
-				RecipientDomain: domain,
-				MessageId:       msg.MessageId})
+	sendAfter, err := TakeSendAfter(&msg, entry.Body)
+	if err != nil {
+		log.Error("message %s can't read %s, DROPPED: %s", msg.String(), DELIVER_AFTER_HEADER, err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
+	}
+	if email.SendAfter != nil {
+		sendAfter = time.Time{}
+		if at := email.GetSendAfter(); at > 0 {
+			sendAfter = time.Unix(at, 0)
 		}
-		for _, entry := range entries {
-			PushMail(entry)
+	}
+	if sendAfter.After(time.Now()) {
+		if ScheduledQueueFull(len(msg.RcptDomains)) {
+			log.Warn("message %s DEFERRED: %s", msg.String(), ErrScheduledFull.Error())
+			return nil, nil, ErrScheduledFull
 		}
+		log.Info("msg %s SCHEDULED after %s", msg.String(), sendAfter.Format(time.RFC3339))
+	}
 
+	peer := smtpd.Peer{Addr: conn.RemoteAddr(), ServerName: conf.ServerHostName, Protocol: PROTOCOL_TCP}
+	if err = AddTraceHeaders(entry.Body, peer, queueId, LISTENER_TCP); err != nil {
+		log.Error("message %s can't add trace headers, DROPPED: %s", msg.String(), err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
 	}
 
-	return
+	priority, err := TakePriority(&msg, entry.Body, conf.TCPPriority)
+	if err != nil {
+		log.Error("message %s can't remove %s, DROPPED: %s", msg.String(), PRIORITY_HEADER, err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
+	}
+
+	campaign, err := TakeCampaignId(&msg, entry.Body)
+	if err != nil {
+		log.Error("message %s can't remove %s, DROPPED: %s", msg.String(), CAMPAIGN_HEADER, err.Error())
+		MailDroppedIncreaseCounter(1)
+		return nil, nil, ErrMessageError
+	}
+
+	signature := &DKIMSignature{}
+	if email.Priority != nil {
+		priority = int(email.GetPriority())
+	}
+	if email.CampaignId != nil {
+		campaign = CampaignId(email.GetCampaignId())
+	}
+	for domain, _ := range msg.RcptDomains {
+
+		var mailServer string
+		mailServer, err = lookupMailServer(strings.ToLower(domain), 0)
+		if err != nil {
+			log.Error("message %s can't get MX record for %s - %s, DROPPED: %s", msg.String(), domain, err.Error(), ErrDomainNotFound.Error())
+			MailDroppedIncreaseCounter(1)
+			return nil, nil, ErrDomainNotFound
+		}
+
+		if conf.RelayModeEnabled {
+			mailServer = conf.RelayServer
+		}
+
+		entries = append(entries, QueueEntry{MailServer: mailServer,
+			Id:              SubQueueId(queueId, len(entries)+1),
+			QueueId:         queueId,
+			Sender:          entry.Sender,
+			Recipients:      msg.GetDomainRecipientList(domain),
+			Body:            entry.Body,
+			Signature:       signature,
+			SMTPUTF8:        msg.NeedsSMTPUTF8(),
+			Priority:        priority,
+			SendAfter:       sendAfter,
+			UnqueueTime:     sendAfter,
+			CampaignId:      campaign,
+			SenderDomain:    msg.Sender.Domain,
+			RecipientDomain: domain,
+			MessageId:       msg.MessageId})
+	}
+	return entry.Body, entries, nil
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"smtprelay/smtpd"
+	"smtprelay/spool"
+)
+
+// Protocol named in the Received header of messages from the TCP listener
+const PROTOCOL_TCP smtpd.Protocol = "TCP"
+
+// AddTraceHeaders prepends a Received header for the message accepted from
+// peer as queueId and, with XRelayHeaders, the X-Relay headers, ending their
+// lines like the message's own. This is done on intake, so the headers are
+// in place before DKIM signing.
+func AddTraceHeaders(body *spool.Body, peer smtpd.Peer, queueId string, listener string) error {
+	data, err := body.Open()
+	if err != nil {
+		return err
+	}
+	_, eol, _, err := readHeaderFields(data)
+	data.Close()
+	if err != nil {
+		return err
+	}
+	if conf.XRelayHeaders {
+		var headers bytes.Buffer
+		fmt.Fprintf(&headers, "X-Relay-Queue-Id: %s%s", queueId, eol)
+		fmt.Fprintf(&headers, "X-Relay-Listener: %s%s", listener, eol)
+		if ip := AddrIP(peer.Addr); ip != nil {
+			fmt.Fprintf(&headers, "X-Relay-Client: %s%s", ip.String(), eol)
+		}
+		if peer.Username != "" {
+			fmt.Fprintf(&headers, "X-Relay-Auth-User: %s%s", peer.Username, eol)
+		}
+		body.Prepend(headers.Bytes())
+	}
+	body.Prepend(bytes.Replace(smtpd.ReceivedLine(peer, queueId), []byte("\r\n"), []byte(eol), -1))
+	return nil
+}
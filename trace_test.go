@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"smtprelay/smtpd"
+	"smtprelay/spool"
+	"strings"
+	"testing"
+)
+
+func TestAddTraceHeaders(t *testing.T) {
+	conf = &Conf{XRelayHeaders: true}
+	body := spool.NewBody([]byte("Subject: test\r\n\r\nbody\r\n"))
+	peer := smtpd.Peer{
+		HeloName:   "client.example.com",
+		Username:   "alice",
+		Protocol:   smtpd.ESMTP,
+		ServerName: "relay.example.net",
+		Addr:       &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 4242},
+	}
+	if err := AddTraceHeaders(body, peer, "0123abcd", "submission"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := body.Bytes()
+	expect := "Received: from client.example.com [192.0.2.10] by relay.example.net with ESMTPA\r\n\tid 0123abcd\r\n\t(authenticated as alice);\r\n\t"
+	if !strings.HasPrefix(string(data), expect) {
+		t.Errorf("expect prefix '%s', got - '%s'", expect, data)
+	}
+	expect = "X-Relay-Queue-Id: 0123abcd\r\nX-Relay-Listener: submission\r\nX-Relay-Client: 192.0.2.10\r\nX-Relay-Auth-User: alice\r\nSubject: test\r\n"
+	if !strings.Contains(string(data), expect) {
+		t.Errorf("expect '%s', got - '%s'", expect, data)
+	}
+
+	// A message with bare LF line ends keeps them
+	body = spool.NewBody([]byte("Subject: test\n\nbody\n"))
+	if err := AddTraceHeaders(body, peer, "0123abcd", "submission"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = body.Bytes()
+	if strings.Contains(string(data), "\r") {
+		t.Errorf("expect LF line ends only, got - '%s'", data)
+	}
+	if !strings.Contains(string(data), "X-Relay-Auth-User: alice\nSubject: test\n") {
+		t.Errorf("expect X-Relay headers ending in LF, got - '%s'", data)
+	}
+}